@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,32 +15,145 @@ import (
 // variable that is shared by all Do() calls. See the example for a demonstration.
 //
 // Budget calculates the rate of initial calls and the rate of retries over a
-// moving one minute window. If the rate of retries exceeds Budget.Rate and the
-// ratio of retries exceeds Budget.Ratio, then retries are dropped.
-// The Do() function returns ErrExhausted in this case.
+// moving window, one minute by default. If the rate of calls exceeds
+// Budget.Rate and the ratio of retries exceeds Budget.Ratio, then retries are
+// dropped. The Do() function returns ErrExhausted in this case.
 //
 // Implements the Option interface.
 type Budget struct {
-	// Rate is the minimum rate of retries (in calls per second).
-	// If fewer retries are attempted than this rate, retries are never throttled.
+	// Rate is the minimum rate of calls (in calls per second). If fewer
+	// calls are made than this rate, retries are never throttled. Like
+	// the ratio, the rate depends on RatioMode: it is the rate of initial
+	// calls with RetriesPerInitial and the rate of all calls, including
+	// retries, with RetriesPerTotal.
 	Rate float64
 
-	// Ratio is the maximum ratio of retries.
-	// When used as an option to Do(), it's the ratio of retries to initial
-	// calls. In that case ratio is a number in the [0.0, Attempts()]
-	// range. The initial request is never dropped.
-	// When used as part of BudgetHandler, it's the ratio of retries to
-	// total requests. In that case ratio is a number in the [0.0, 1.0]
-	// range.
+	// Ratio is the maximum ratio of retries. How the ratio is calculated
+	// depends on RatioMode.
 	Ratio float64
 
-	mu           sync.Mutex
+	// RatioMode specifies whether Ratio is the ratio of retries to
+	// initial calls or the ratio of retries to total calls. The zero value
+	// uses retries per initial call with Do() and retries per total call
+	// with BudgetHandler, for backwards compatibility. Set RatioMode
+	// explicitly when the same configuration is used on both sides.
+	RatioMode RatioMode
+
+	// Window is the length of the moving window over which rates are
+	// calculated. Short windows react quickly to bursts, long windows
+	// ignore spikes. Defaults to one minute.
+	Window time.Duration
+
+	// Resolution is the granularity with which the window moves forward.
+	// Window does not need to be a multiple of Resolution. Defaults to one
+	// second.
+	Resolution time.Duration
+
+	// Store, if not nil, shares the budget with other processes. See
+	// BudgetStore for details.
+	Store BudgetStore
+
+	// StoreKey identifies the budget in Store. Budgets with the same key
+	// share their state.
+	StoreKey string
+
+	// SyncInterval is the interval in which the calls made locally are
+	// exchanged with Store. Defaults to one second.
+	SyncInterval time.Duration
+
+	// Rand is the RandSource used to randomize the backoff delays of calls
+	// using the budget. A RandSource passed to the call takes precedence.
+	// Defaults to a shared, concurrency-safe generator.
+	Rand RandSource
+
+	once         sync.Once
 	initialCalls *movingRate
 	retriedCalls *movingRate
+
+	refused   atomic.Uint64
+	overloads atomic.Uint64
+	rewrites  atomic.Uint64
+	// handler is set when the budget is used by BudgetHandler, which
+	// selects the server side DefaultRatioMode.
+	handler atomic.Bool
+
+	// state shared via Store
+	pendingInitial atomic.Int64
+	pendingRetried atomic.Int64
+	storeClient    string
+	storeSeq       atomic.Uint64
+	lastSync       atomic.Int64
+	syncing        atomic.Bool
+	global         atomic.Pointer[globalRates]
 }
 
 func (b *Budget) apply(opts *internalOptions) {
 	opts.budget = b
+	opts.budgetRand = b.Rand
+}
+
+const (
+	defaultWindow     = time.Minute
+	defaultResolution = time.Second
+
+	// maxBuckets limits the memory used by a moving window.
+	maxBuckets = 100000
+)
+
+func (b *Budget) window() time.Duration {
+	if b.Window == 0 {
+		return defaultWindow
+	}
+	return b.Window
+}
+
+func (b *Budget) resolution() time.Duration {
+	if b.Resolution == 0 {
+		return defaultResolution
+	}
+	return b.Resolution
+}
+
+// Validate checks the Budget's settings. Do() calls Validate and returns its
+// error, if any, before making the first call.
+func (b *Budget) Validate() error {
+	switch {
+	case b == nil:
+		return nil
+	case b.Rate < 0 || math.IsNaN(b.Rate):
+		return fmt.Errorf("invalid Budget.Rate %g: must not be negative", b.Rate)
+	case b.Ratio < 0 || math.IsNaN(b.Ratio):
+		return fmt.Errorf("invalid Budget.Ratio %g: must not be negative", b.Ratio)
+	case b.RatioMode < DefaultRatioMode || b.RatioMode > RetriesPerTotal:
+		return fmt.Errorf("invalid Budget.RatioMode %d", b.RatioMode)
+	case b.RatioMode == RetriesPerTotal && b.Ratio > 1:
+		return fmt.Errorf("invalid Budget.Ratio %g: must not exceed 1.0 with RetriesPerTotal", b.Ratio)
+	case b.Window < 0:
+		return fmt.Errorf("invalid Budget.Window %v: must not be negative", b.Window)
+	case b.Resolution < 0:
+		return fmt.Errorf("invalid Budget.Resolution %v: must not be negative", b.Resolution)
+	case b.resolution() > b.window():
+		return fmt.Errorf("invalid Budget.Resolution %v: must not exceed Budget.Window (%v)", b.resolution(), b.window())
+	case b.SyncInterval < 0:
+		return fmt.Errorf("invalid Budget.SyncInterval %v: must not be negative", b.SyncInterval)
+	case b.window()/b.resolution() > maxBuckets:
+		return fmt.Errorf("invalid Budget.Resolution %v: Budget.Window (%v) must not exceed %d times the resolution",
+			b.resolution(), b.window(), maxBuckets)
+	}
+
+	return nil
+}
+
+func (b *Budget) init() {
+	b.once.Do(func() {
+		b.initialCalls = newMovingRate(b.window(), b.resolution())
+		b.retriedCalls = newMovingRate(b.window(), b.resolution())
+		b.lastSync.Store(time.Now().UnixNano())
+		if b.Store != nil {
+			b.storeClient = newStoreClientID()
+			b.storeSeq.Store(1)
+		}
+	})
 }
 
 // sendOK checks on the client side if a request should be sent. The first
@@ -49,188 +163,488 @@ func (b *Budget) sendOK(isRetry bool) bool {
 		return true
 	}
 
-	b.mu.Lock()
-	defer b.mu.Unlock()
-
-	if b.retriedCalls == nil {
-		b.retriedCalls = newMovingRate()
-	}
-	if b.initialCalls == nil {
-		b.initialCalls = newMovingRate()
-	}
+	b.init()
 
 	t := time.Now()
 
 	if !isRetry {
-		b.initialCalls.Add(t, 1)
+		b.add(t, false)
 		return true
 	}
 
-	initialRate := b.initialCalls.Rate(t)
-	retriedRate := b.retriedCalls.Rate(t)
-	if initialRate > b.Rate &&
+	// Reserve the retry before checking the budget. Concurrent retries
+	// see each other's reservations, so that they cannot all pass the
+	// check before any of them is accounted.
+	b.retriedCalls.Add(t, 1)
+
+	initialRate, retriedRate, shared := b.rates(t)
+	if !shared {
+		// The reservation itself does not count against the budget.
+		retriedRate -= 1 / b.retriedCalls.secondAt(t.UnixNano())
+	}
+	if b.exceeded(initialRate, retriedRate, RetriesPerInitial) {
 		// not accounted
-		retriedRate/initialRate > b.Ratio {
+		b.retriedCalls.Add(t, -1)
+		b.refused.Add(1)
 		return false
 	}
 
-	b.retriedCalls.Add(t, 1)
+	b.addPending(t, true)
 	return true
 }
 
+// add accounts a call at time t.
+func (b *Budget) add(t time.Time, isRetry bool) {
+	if isRetry {
+		b.retriedCalls.Add(t, 1)
+	} else {
+		b.initialCalls.Add(t, 1)
+	}
+
+	b.addPending(t, isRetry)
+}
+
+// addPending accounts a call at time t for the next exchange with Store.
+func (b *Budget) addPending(t time.Time, isRetry bool) {
+	if b.Store == nil {
+		return
+	}
+
+	if isRetry {
+		b.pendingRetried.Add(1)
+	} else {
+		b.pendingInitial.Add(1)
+	}
+	b.maybeSync(t)
+}
+
+// rates returns the rates of initial calls and retries at time t. If the
+// budget is shared via Store, the global rates are returned and shared is true.
+func (b *Budget) rates(t time.Time) (initialRate, retriedRate float64, shared bool) {
+	initialRate = b.initialCalls.Rate(t)
+	retriedRate = b.retriedCalls.Rate(t)
+
+	if g := b.globalRates(t); g != nil {
+		return g.initialRate, g.retriedRate, true
+	}
+	return initialRate, retriedRate, false
+}
+
+// defaultMode returns the ratio mode used for DefaultRatioMode: RetriesPerTotal
+// if the budget is used by BudgetHandler, RetriesPerInitial otherwise.
+func (b *Budget) defaultMode() RatioMode {
+	if b.handler.Load() {
+		return RetriesPerTotal
+	}
+	return RetriesPerInitial
+}
+
+// mode returns the ratio mode, using def if RatioMode is DefaultRatioMode.
+func (b *Budget) mode(def RatioMode) RatioMode {
+	if b.RatioMode == DefaultRatioMode {
+		return def
+	}
+	return b.RatioMode
+}
+
+// ratio returns the ratio of retries in the given mode.
+func ratio(initialRate, retriedRate float64, mode RatioMode) float64 {
+	base := initialRate
+	if mode == RetriesPerTotal {
+		base += retriedRate
+	}
+	if base == 0 {
+		return 0
+	}
+	return retriedRate / base
+}
+
+// exceeded reports whether the retry budget is exceeded. def is the ratio mode
+// used if RatioMode is DefaultRatioMode. The rate of calls in the denominator
+// of the ratio, i.e. initial calls or total calls, must exceed b.Rate.
+func (b *Budget) exceeded(initialRate, retriedRate float64, def RatioMode) bool {
+	base := initialRate
+	if b.mode(def) == RetriesPerTotal {
+		base += retriedRate
+	}
+
+	return base > b.Rate && retriedRate/base > b.Ratio
+}
+
 // overload checks on the server side if the cluster appears to be in overload.
 // May return true even for initial (non-retried) requests and accounts all
-// requests, even when overload is signaled.
+// requests, even when overload is signaled. If the budget is invalid, overload
+// fails closed, i.e. it always signals overload.
 func (b *Budget) overload(isRetry bool) bool {
 	if b == nil {
 		return true
 	}
+	b.handler.Store(true)
+	if b.Validate() != nil {
+		b.overloads.Add(1)
+		return true
+	}
+
+	b.init()
+
+	t := time.Now()
 
-	b.mu.Lock()
-	defer b.mu.Unlock()
+	b.add(t, isRetry)
 
-	if b.retriedCalls == nil {
-		b.retriedCalls = newMovingRate()
+	initialRate, retriedRate, _ := b.rates(t)
+	if b.exceeded(initialRate, retriedRate, RetriesPerTotal) {
+		b.overloads.Add(1)
+		return true
 	}
-	if b.initialCalls == nil {
-		b.initialCalls = newMovingRate()
+	return false
+}
+
+// RatioMode specifies how the ratio of retries is calculated, see Budget.RatioMode.
+type RatioMode int
+
+const (
+	// DefaultRatioMode uses RetriesPerInitial on the client side, i.e.
+	// with Do() and Transport, and RetriesPerTotal on the server side,
+	// i.e. with BudgetHandler.
+	DefaultRatioMode RatioMode = iota
+
+	// RetriesPerInitial is the ratio of retries to initial calls. The
+	// ratio is in the [0.0, Attempts()-1] range.
+	RetriesPerInitial
+
+	// RetriesPerTotal is the ratio of retries to all calls, i.e. initial
+	// calls plus retries. The ratio is in the [0.0, 1.0] range.
+	RetriesPerTotal
+)
+
+// PerTotalRatio converts a ratio of retries to initial calls into the
+// equivalent ratio of retries to total calls. For example, 0.25 retries per
+// initial call equals 0.2 retries per total call.
+//
+// Budget.Rate is not converted, because it is compared to the rate of
+// initial calls in one mode and to the rate of all calls in the other.
+// Multiplying Rate by 1+retriesPerInitial yields the same threshold while the
+// ratio of retries is at the limit. Above the limit, the retries count
+// towards Rate with RetriesPerTotal, so that budget is exhausted at a lower
+// rate of initial calls.
+func PerTotalRatio(retriesPerInitial float64) float64 {
+	return retriesPerInitial / (1.0 + retriesPerInitial)
+}
+
+// PerInitialRatio converts a ratio of retries to total calls into the
+// equivalent ratio of retries to initial calls. For example, 0.2 retries per
+// total call equals 0.25 retries per initial call. Returns +Inf for 1.0.
+//
+// As with PerTotalRatio, Budget.Rate is not converted. Dividing Rate by
+// 1+PerInitialRatio(retriesPerTotal), i.e. multiplying it by
+// 1-retriesPerTotal, yields the same threshold while the ratio of retries is
+// at the limit.
+func PerInitialRatio(retriesPerTotal float64) float64 {
+	return retriesPerTotal / (1.0 - retriesPerTotal)
+}
+
+// BudgetStats is a snapshot of a Budget's state, as returned by Budget.Stats().
+type BudgetStats struct {
+	// InitialRate and RetryRate are the rates of initial calls and
+	// retries in the moving window, in calls per second. If the budget
+	// is shared via Budget.Store, these are the global rates.
+	InitialRate float64
+	RetryRate   float64
+
+	// Ratio is the effective ratio of retries, calculated as specified
+	// by Budget.RatioMode. If RatioMode is DefaultRatioMode, this is the
+	// ratio of retries to total calls if the budget is used by
+	// BudgetHandler, and the ratio of retries to initial calls otherwise,
+	// i.e. the value compared to Budget.Ratio.
+	Ratio float64
+
+	// Refused is the number of retries refused by the budget, i.e. the
+	// number of times Do() returned ErrExhausted.
+	Refused uint64
+
+	// Overloads is the number of requests that BudgetHandler handled
+	// while in overload.
+	Overloads uint64
+
+	// Rewrites is the number of responses whose status code
+	// BudgetHandler changed to 429 "Too Many Requests" while in overload.
+	Rewrites uint64
+
+	// Exhausted is true if the budget currently refuses retries or, if
+	// used by BudgetHandler, signals overload. It uses the same mode as
+	// Ratio.
+	Exhausted bool
+
+	// Err is the error returned by Budget.Validate, if any. An invalid
+	// budget makes Do() fail and BudgetHandler signal overload for every
+	// request; the rates are not calculated.
+	Err error
+}
+
+// Stats returns a snapshot of the budget's current state. It is safe to call
+// Stats concurrently with Do() and BudgetHandler. Calling Stats does not
+// account any calls. A nil budget returns the zero value.
+func (b *Budget) Stats() BudgetStats {
+	if b == nil {
+		return BudgetStats{}
 	}
 
-	t := time.Now()
+	stats := BudgetStats{
+		Refused:   b.refused.Load(),
+		Overloads: b.overloads.Load(),
+		Rewrites:  b.rewrites.Load(),
+	}
+	if err := b.Validate(); err != nil {
+		stats.Err = err
+		return stats
+	}
 
-	if isRetry {
-		b.retriedCalls.Add(t, 1)
-	} else {
-		b.initialCalls.Add(t, 1)
+	b.init()
+
+	t := time.Now()
+	stats.InitialRate = b.initialCalls.rateAt(t.UnixNano())
+	stats.RetryRate = b.retriedCalls.rateAt(t.UnixNano())
+	if g := b.globalRates(t); g != nil {
+		stats.InitialRate, stats.RetryRate = g.initialRate, g.retriedRate
 	}
 
-	initialRate := b.initialCalls.Rate(t)
-	retriedRate := b.retriedCalls.Rate(t)
-	// TODO(octo): this calculates the ratio as retried/total, while
-	// sendOK() uses retried/initial. That's confusing.
-	totalRate := initialRate + retriedRate
+	stats.Ratio = ratio(stats.InitialRate, stats.RetryRate, b.mode(b.defaultMode()))
+	stats.Exhausted = b.exceeded(stats.InitialRate, stats.RetryRate, b.defaultMode())
 
-	return totalRate > b.Rate && retriedRate/totalRate > b.Ratio
+	return stats
 }
 
+// timeRoundDown returns the result of rounding t down to a multiple of d since
+// the Unix epoch.
 func timeRoundDown(t time.Time, d time.Duration) time.Time {
-	rt := t.Round(d)
-	if rt.After(t) {
-		rt = rt.Add(-d)
-	}
+	return t.Add(-time.Duration(floorMod(t.UnixNano(), int64(d))))
+}
 
-	return rt
+// floorMod returns the non-negative remainder of a/b for positive b.
+func floorMod(a, b int64) int64 {
+	m := a % b
+	if m < 0 {
+		m += b
+	}
+	return m
 }
 
+// movingRate counts events in a moving window and calculates their rate.
+//
+// movingRate is safe for concurrent use and does not block: the window is a
+// ring of BucketNum+1 buckets, each of which points to the bucket's epoch and
+// count. Counts are updated atomically; a bucket whose epoch is outdated is
+// replaced with compare-and-swap by the first writer that notices.
 type movingRate struct {
 	BucketLength time.Duration
 	BucketNum    int
 
-	counts     []int
-	lastUpdate time.Time
+	// Window is the length of the moving window. If zero, the window is
+	// BucketNum * BucketLength long. Otherwise, BucketNum must be at least
+	// Window / BucketLength, rounded up.
+	Window time.Duration
+
+	once    sync.Once
+	buckets []atomic.Pointer[rateBucket]
+	// first is the time (in Unix nanoseconds) the window was first
+	// updated, last is the latest time the window was updated.
+	first atomic.Int64
+	last  atomic.Int64
+}
+
+// rateBucket counts the events of one epoch, see movingRate.epoch.
+type rateBucket struct {
+	epoch int64
+	count atomic.Int64
 }
 
-func newMovingRate() *movingRate {
+func newMovingRate(window, resolution time.Duration) *movingRate {
 	return &movingRate{
-		BucketLength: time.Second,
-		BucketNum:    60,
+		BucketLength: resolution,
+		BucketNum:    int((window + resolution - 1) / resolution),
+		Window:       window,
 	}
 }
 
-func (mr *movingRate) count() float64 {
-	// history is not yet fully initialized
-	if len(mr.counts) <= mr.BucketNum {
-		var s float64
-		for _, c := range mr.counts {
-			s += float64(c)
+func (mr *movingRate) init() {
+	mr.once.Do(func() {
+		// we actually keep BucketNum+1 buckets -- the newest and
+		// oldest buckets are partially evaluated so the window length
+		// stays constant.
+		mr.buckets = make([]atomic.Pointer[rateBucket], mr.BucketNum+1)
+	})
+}
+
+func (mr *movingRate) window() time.Duration {
+	if mr.Window == 0 {
+		return time.Duration(mr.BucketNum) * mr.BucketLength
+	}
+	return mr.Window
+}
+
+// epoch returns the index of the bucket that the time ns (in Unix
+// nanoseconds) belongs to, and the time elapsed since the start of the bucket.
+func (mr *movingRate) epoch(ns int64) (int64, time.Duration) {
+	elapsed := floorMod(ns, int64(mr.BucketLength))
+	return (ns - elapsed) / int64(mr.BucketLength), time.Duration(elapsed)
+}
+
+// index returns the position of the bucket with the given epoch in the ring.
+func (mr *movingRate) index(epoch int64) int {
+	return int(floorMod(epoch, int64(len(mr.buckets))))
+}
+
+// touch records that the window has been updated at ns.
+func (mr *movingRate) touch(ns int64) {
+	mr.first.CompareAndSwap(0, ns)
+	for {
+		last := mr.last.Load()
+		if last >= ns || mr.last.CompareAndSwap(last, ns) {
+			return
 		}
-		return s
 	}
+}
+
+// bucket returns the count of the bucket with the given epoch, stored at index
+// i, or zero if the bucket has been reset since.
+func (mr *movingRate) bucket(i int, epoch int64) float64 {
+	b := mr.buckets[i].Load()
+	if b == nil || b.epoch != epoch {
+		return 0
+	}
+	return float64(b.count.Load())
+}
+
+func (mr *movingRate) countAt(ns int64) float64 {
+	epoch, elapsed := mr.epoch(ns)
+	n := len(mr.buckets)
+	i := mr.index(epoch)
+
+	// The newest bucket is counted in full. Older buckets are counted in
+	// full while they are completely inside the window; the oldest bucket
+	// that is only partially inside the window is weighted by the
+	// fraction that is still inside. While the history is not yet fully
+	// initialized, all buckets are inside the window.
+	remaining := mr.window() - elapsed
+
+	s := mr.bucket(i, epoch)
+	for k := 1; k < n && remaining > 0; k++ {
+		if i == 0 {
+			i = n
+		}
+		i--
 
-	oldestFraction := 1.0 -
-		float64(mr.lastUpdate.Sub(timeRoundDown(mr.lastUpdate, mr.BucketLength)))/
-			float64(mr.BucketLength)
+		c := mr.bucket(i, epoch-int64(k))
+		if remaining >= mr.BucketLength {
+			s += c
+			remaining -= mr.BucketLength
+			continue
+		}
 
-	s := oldestFraction * float64(mr.counts[0])
-	for i := 1; i < len(mr.counts); i++ {
-		s += float64(mr.counts[i])
+		s += float64(remaining) / float64(mr.BucketLength) * c
+		remaining = 0
 	}
 
 	return s
 }
 
-func (mr *movingRate) second() float64 {
-	if len(mr.counts) == 0 {
+func (mr *movingRate) secondAt(ns int64) float64 {
+	first := mr.first.Load()
+	if first == 0 {
 		return 0.0
 	}
 
-	// history is not yet fully initialized
-	if len(mr.counts) <= mr.BucketNum {
-		d := time.Duration(len(mr.counts)-1) * mr.BucketLength
-		d += mr.lastUpdate.Sub(timeRoundDown(mr.lastUpdate, mr.BucketLength))
-		return d.Seconds()
+	// While the history is not yet fully initialized, the covered period
+	// is shorter than the window.
+	d := time.Duration(ns - (first - floorMod(first, int64(mr.BucketLength))))
+	if w := mr.window(); d > w {
+		d = w
+	} else if d < 0 {
+		d = 0
 	}
 
-	d := time.Duration(mr.BucketNum) * mr.BucketLength
 	return d.Seconds()
 }
 
-func (mr *movingRate) shift(n int) {
-	if n > mr.BucketNum+1 {
-		n = mr.BucketNum + 1
-	}
-
-	zero := make([]int, n)
-	mr.counts = append(mr.counts, zero...)
+// count returns the number of events in the window ending at the time of the
+// latest update.
+func (mr *movingRate) count() float64 {
+	mr.init()
+	return mr.countAt(mr.last.Load())
+}
 
-	// we actually keep BucketNum+1 buckets -- the newest and oldest
-	// buckets are partially evaluated so the window length stays constant.
-	if del := len(mr.counts) - (mr.BucketNum + 1); del > 0 {
-		mr.counts = mr.counts[del:]
-	}
+// second returns the length of the window ending at the time of the latest
+// update, in seconds.
+func (mr *movingRate) second() float64 {
+	return mr.secondAt(mr.last.Load())
+}
 
-	mr.lastUpdate = timeRoundDown(mr.lastUpdate, mr.BucketLength).Add(time.Duration(n) * mr.BucketLength)
+// rateAt returns the rate at ns without updating the window. It returns zero
+// if the window has not been updated yet.
+func (mr *movingRate) rateAt(ns int64) float64 {
+	mr.init()
 
+	sec := mr.secondAt(ns)
+	if sec <= 0 {
+		return 0.0
+	}
+	return mr.countAt(ns) / sec
 }
 
-func (mr *movingRate) forward(t time.Time) {
-	defer func() {
-		mr.lastUpdate = t
-	}()
+// Add adds n events at time t. A negative n removes events added at the same
+// time t, e.g. to roll back a reservation.
+func (mr *movingRate) Add(t time.Time, n int) {
+	ns := t.UnixNano()
+	mr.init()
+	mr.touch(ns)
 
-	if mr.lastUpdate.IsZero() {
-		mr.counts = []int{0}
-		return
-	}
+	epoch, _ := mr.epoch(ns)
+	mr.addEpoch(epoch, n)
+}
 
-	rt := timeRoundDown(t, mr.BucketLength)
-	if !rt.After(mr.lastUpdate) {
-		return
-	}
+// addEpoch adds n to the bucket with the given epoch.
+func (mr *movingRate) addEpoch(epoch int64, n int) {
+	b := &mr.buckets[mr.index(epoch)]
+
+	var fresh *rateBucket
+	for {
+		old := b.Load()
+		switch {
+		case old != nil && old.epoch == epoch:
+			// If old is replaced concurrently, the events are
+			// outside of the window anyway.
+			old.count.Add(int64(n))
+			return
+		case n < 0:
+			// The events to remove are no longer in the bucket.
+			return
+		case old != nil && old.epoch > epoch:
+			// epoch is so old that the bucket has already been reused.
+			return
+		}
 
-	n := int(rt.Sub(timeRoundDown(mr.lastUpdate, mr.BucketLength)) / mr.BucketLength)
-	if n <= 0 {
-		panic(fmt.Sprintf("assertion failure: n = %d, want >0; rt = %v, mr.lastUpdate = %v, mr.BucketLength = %v",
-			n, rt, mr.lastUpdate, mr.BucketLength))
+		if fresh == nil {
+			fresh = &rateBucket{epoch: epoch}
+			fresh.count.Store(int64(n))
+		}
+		if b.CompareAndSwap(old, fresh) {
+			return
+		}
 	}
-
-	mr.shift(n)
 }
 
-func (mr *movingRate) Add(t time.Time, n int) {
-	if t.Before(mr.lastUpdate) {
-		return
-	}
+func (mr *movingRate) Count(t time.Time) float64 {
+	ns := t.UnixNano()
+	mr.init()
+	mr.touch(ns)
 
-	mr.forward(t)
-	mr.counts[len(mr.counts)-1] += n
+	return mr.countAt(ns)
 }
 
 func (mr *movingRate) Rate(t time.Time) float64 {
-	if t.Before(mr.lastUpdate) {
-		return math.NaN()
-	}
+	ns := t.UnixNano()
+	mr.init()
+	mr.touch(ns)
 
-	mr.forward(t)
-	return mr.count() / mr.second()
+	return mr.countAt(ns) / mr.secondAt(ns)
 }
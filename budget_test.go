@@ -3,6 +3,7 @@ package retry
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"math"
 	"math/rand"
@@ -106,6 +107,57 @@ func TestBudget(t *testing.T) {
 	}
 }
 
+// TestBudgetConcurrentRetries ensures that concurrent retries cannot exceed the
+// budget by passing the check before any of them is accounted.
+func TestBudgetConcurrentRetries(t *testing.T) {
+	for _, concurrent := range []bool{false, true} {
+		b := &Budget{Ratio: 0.1}
+		for i := 0; i < 100; i++ {
+			b.sendOK(false)
+		}
+
+		var (
+			wg     sync.WaitGroup
+			mu     sync.Mutex
+			passed int
+			start  = make(chan struct{})
+		)
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if concurrent {
+					<-start
+				}
+				if b.sendOK(true) {
+					mu.Lock()
+					passed++
+					mu.Unlock()
+				}
+			}()
+			if !concurrent {
+				wg.Wait()
+			}
+		}
+		close(start)
+		wg.Wait()
+
+		// Retries are permitted while the ratio of previous retries
+		// does not exceed 0.1, i.e. up to 11 retries per 100 calls.
+		if concurrent && passed > 11 {
+			t.Errorf("concurrent: %d retries passed, want at most 11", passed)
+		}
+		if !concurrent && passed != 11 {
+			t.Errorf("sequential: %d retries passed, want 11", passed)
+		}
+
+		// Refused retries are not accounted.
+		if got := b.retriedCalls.count(); got != float64(passed) {
+			t.Errorf("concurrent = %v: accounted %g retries, want %d", concurrent, got, passed)
+		}
+	}
+}
+
 func TestMovingRate(t *testing.T) {
 	cases := []struct {
 		calls      []int
@@ -189,3 +241,564 @@ func TestMovingRate(t *testing.T) {
 		t.Logf("AFTER  mr = %+v", mr)
 	}
 }
+
+// TestMovingRateEpochWrap ensures that buckets are indexed correctly when the
+// epoch exceeds 32 bits, e.g. with a resolution of one millisecond.
+func TestMovingRateEpochWrap(t *testing.T) {
+	mr := newMovingRate(10*time.Millisecond, time.Millisecond)
+
+	start := time.Unix(0, (1<<32-5)*int64(time.Millisecond))
+	for i := 0; i < 10; i++ {
+		mr.Add(start.Add(time.Duration(i)*time.Millisecond), 1)
+	}
+
+	if got, want := mr.Count(start.Add(9*time.Millisecond)), 10.0; got != want {
+		t.Errorf("Count() = %g, want %g", got, want)
+	}
+}
+
+func TestMovingRateUnevenWindow(t *testing.T) {
+	cases := []struct {
+		calls      []int
+		elapsed    time.Duration
+		wantCount  float64
+		wantSecond float64
+	}{
+		{
+			calls:      []int{5},
+			elapsed:    2500 * time.Millisecond,
+			wantCount:  5,
+			wantSecond: 2.5,
+		},
+		{
+			calls:      []int{5, 3},
+			elapsed:    2500 * time.Millisecond,
+			wantCount:  8,
+			wantSecond: 5.5,
+		},
+		{
+			calls:      []int{1, 2, 3, 4},
+			elapsed:    500 * time.Millisecond,
+			wantCount:  10,
+			wantSecond: 9.5,
+		},
+		{
+			calls: []int{
+				1000, // old
+				100,  // partial, half of the bucket is inside the window
+				10, 10,
+				1,
+			},
+			elapsed:    2500 * time.Millisecond,
+			wantCount:  100*.5 + 10 + 10 + 1,
+			wantSecond: 10.0,
+		},
+		{
+			calls: []int{
+				1000, 1000, // old
+				100, // partial, five sixths of the bucket are inside the window
+				10, 10,
+				1,
+			},
+			elapsed:    1500 * time.Millisecond,
+			wantCount:  100.0*5.0/6.0 + 10 + 10 + 1,
+			wantSecond: 10.0,
+		},
+		{
+			calls: []int{
+				1000, 1000, // old
+				100, // outside of the window
+				10, 10, 10,
+				1,
+			},
+			elapsed:    1000 * time.Millisecond,
+			wantCount:  10 + 10 + 10 + 1,
+			wantSecond: 10.0,
+		},
+	}
+
+	for _, c := range cases {
+		mr := newMovingRate(10*time.Second, 3*time.Second)
+		if got, want := mr.BucketNum, 4; got != want {
+			t.Fatalf("newMovingRate(10s, 3s).BucketNum = %d, want %d", got, want)
+		}
+
+		base := timeRoundDown(time.Date(2018, time.February, 22, 22, 24, 53, 0, time.UTC), mr.BucketLength)
+		var tm time.Time
+		for i, n := range c.calls {
+			tm = base.Add(time.Duration(i) * mr.BucketLength)
+			mr.Add(tm, n)
+		}
+		tm = tm.Add(c.elapsed)
+
+		if got, want := mr.Count(tm), c.wantCount; math.Abs(got-want) > 1e-9 {
+			t.Errorf("calls = %v: mr.Count() = %g, want %g", c.calls, got, want)
+		}
+
+		if got, want := mr.second(), c.wantSecond; math.Abs(got-want) > 1e-9 {
+			t.Errorf("calls = %v: mr.second() = %g, want %g", c.calls, got, want)
+		}
+	}
+}
+
+func TestBudgetValidate(t *testing.T) {
+	cases := []struct {
+		budget  *Budget
+		wantErr bool
+	}{
+		{budget: &Budget{}},
+		{budget: &Budget{Rate: 1, Ratio: 0.1, Window: 10 * time.Second}},
+		{budget: &Budget{Window: 10 * time.Minute, Resolution: 10 * time.Second}},
+		{budget: &Budget{Window: 10 * time.Second, Resolution: 3 * time.Second}},
+		{budget: &Budget{Resolution: 100 * time.Millisecond}},
+		{budget: &Budget{Rate: -1}, wantErr: true},
+		{budget: &Budget{Ratio: math.NaN()}, wantErr: true},
+		{budget: &Budget{Window: -time.Second}, wantErr: true},
+		{budget: &Budget{Resolution: -time.Second}, wantErr: true},
+		{budget: &Budget{Window: 10 * time.Second, Resolution: time.Minute}, wantErr: true},
+		{budget: &Budget{Window: time.Hour, Resolution: time.Millisecond}, wantErr: true},
+	}
+
+	for _, c := range cases {
+		err := c.budget.Validate()
+		if gotErr := err != nil; gotErr != c.wantErr {
+			t.Errorf("Budget{Rate: %g, Ratio: %g, Window: %v, Resolution: %v}.Validate() = %v, want error: %v",
+				c.budget.Rate, c.budget.Ratio, c.budget.Window, c.budget.Resolution, err, c.wantErr)
+		}
+	}
+
+	ctx := context.Background()
+	cb := func(_ context.Context) error {
+		t.Error("callback called despite invalid budget")
+		return nil
+	}
+	if err := Do(ctx, cb, &Budget{Resolution: time.Hour}); err == nil {
+		t.Errorf("Do() with invalid Budget = %v, want error", err)
+	}
+}
+
+// lockedMovingRate is the mutex based implementation of movingRate that
+// predates the lock-free one. It is the reference for TestMovingRateReference
+// and the baseline for the benchmarks.
+type lockedMovingRate struct {
+	BucketLength time.Duration
+	BucketNum    int
+
+	Window time.Duration
+
+	mu         sync.Mutex
+	counts     []int
+	lastUpdate time.Time
+}
+
+func (mr *lockedMovingRate) window() time.Duration {
+	if mr.Window == 0 {
+		return time.Duration(mr.BucketNum) * mr.BucketLength
+	}
+	return mr.Window
+}
+
+func (mr *lockedMovingRate) count() float64 {
+	if len(mr.counts) == 0 {
+		return 0.0
+	}
+
+	// The newest bucket is counted in full. Older buckets are counted in
+	// full while they are completely inside the window; the oldest bucket
+	// that is only partially inside the window is weighted by the
+	// fraction that is still inside. While the history is not yet fully
+	// initialized, all buckets are inside the window.
+	remaining := mr.window() - mr.lastUpdate.Sub(timeRoundDown(mr.lastUpdate, mr.BucketLength))
+
+	s := float64(mr.counts[len(mr.counts)-1])
+	for i := len(mr.counts) - 2; i >= 0 && remaining > 0; i-- {
+		if remaining >= mr.BucketLength {
+			s += float64(mr.counts[i])
+			remaining -= mr.BucketLength
+			continue
+		}
+
+		s += float64(remaining) / float64(mr.BucketLength) * float64(mr.counts[i])
+		remaining = 0
+	}
+
+	return s
+}
+
+func (mr *lockedMovingRate) second() float64 {
+	if len(mr.counts) == 0 {
+		return 0.0
+	}
+
+	// While the history is not yet fully initialized, the covered period
+	// is shorter than the window.
+	d := time.Duration(len(mr.counts)-1) * mr.BucketLength
+	d += mr.lastUpdate.Sub(timeRoundDown(mr.lastUpdate, mr.BucketLength))
+	if w := mr.window(); d > w {
+		d = w
+	}
+
+	return d.Seconds()
+}
+
+func (mr *lockedMovingRate) shift(n int) {
+	if n > mr.BucketNum+1 {
+		n = mr.BucketNum + 1
+	}
+
+	zero := make([]int, n)
+	mr.counts = append(mr.counts, zero...)
+
+	// we actually keep BucketNum+1 buckets -- the newest and oldest
+	// buckets are partially evaluated so the window length stays constant.
+	if del := len(mr.counts) - (mr.BucketNum + 1); del > 0 {
+		mr.counts = mr.counts[del:]
+	}
+
+	mr.lastUpdate = timeRoundDown(mr.lastUpdate, mr.BucketLength).Add(time.Duration(n) * mr.BucketLength)
+
+}
+
+func (mr *lockedMovingRate) forward(t time.Time) {
+	defer func() {
+		mr.lastUpdate = t
+	}()
+
+	if mr.lastUpdate.IsZero() {
+		mr.counts = []int{0}
+		return
+	}
+
+	rt := timeRoundDown(t, mr.BucketLength)
+	if !rt.After(mr.lastUpdate) {
+		return
+	}
+
+	n := int(rt.Sub(timeRoundDown(mr.lastUpdate, mr.BucketLength)) / mr.BucketLength)
+	if n <= 0 {
+		panic(fmt.Sprintf("assertion failure: n = %d, want >0; rt = %v, mr.lastUpdate = %v, mr.BucketLength = %v",
+			n, rt, mr.lastUpdate, mr.BucketLength))
+	}
+
+	mr.shift(n)
+}
+
+func (mr *lockedMovingRate) Add(t time.Time, n int) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if t.Before(mr.lastUpdate) {
+		return
+	}
+
+	mr.forward(t)
+	mr.counts[len(mr.counts)-1] += n
+}
+
+func (mr *lockedMovingRate) Count(t time.Time) float64 {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if t.Before(mr.lastUpdate) {
+		return math.NaN()
+	}
+
+	mr.forward(t)
+	return mr.count()
+}
+
+func (mr *lockedMovingRate) Rate(t time.Time) float64 {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if t.Before(mr.lastUpdate) {
+		return math.NaN()
+	}
+
+	mr.forward(t)
+	return mr.count() / mr.second()
+}
+
+// lockedBudget implements Budget.sendOK() the way it was implemented before
+// Budget became lock-free.
+type lockedBudget struct {
+	Rate, Ratio float64
+
+	mu           sync.Mutex
+	initialCalls *lockedMovingRate
+	retriedCalls *lockedMovingRate
+}
+
+func (b *lockedBudget) sendOK(isRetry bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.retriedCalls == nil {
+		b.retriedCalls = &lockedMovingRate{BucketLength: time.Second, BucketNum: 60}
+	}
+	if b.initialCalls == nil {
+		b.initialCalls = &lockedMovingRate{BucketLength: time.Second, BucketNum: 60}
+	}
+
+	t := time.Now()
+
+	if !isRetry {
+		b.initialCalls.Add(t, 1)
+		return true
+	}
+
+	initialRate := b.initialCalls.Rate(t)
+	retriedRate := b.retriedCalls.Rate(t)
+	if initialRate > b.Rate && retriedRate/initialRate > b.Ratio {
+		return false
+	}
+
+	b.retriedCalls.Add(t, 1)
+	return true
+}
+
+// TestMovingRateReference compares movingRate to the mutex based reference
+// implementation using random traffic.
+func TestMovingRateReference(t *testing.T) {
+	windows := []struct {
+		window, resolution time.Duration
+	}{
+		{time.Minute, time.Second},
+		{10 * time.Second, time.Second},
+		{10 * time.Second, 3 * time.Second},
+		{10 * time.Minute, 7 * time.Second},
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for _, w := range windows {
+		mr := newMovingRate(w.window, w.resolution)
+		ref := &lockedMovingRate{
+			BucketLength: mr.BucketLength,
+			BucketNum:    mr.BucketNum,
+			Window:       mr.Window,
+		}
+
+		tm := time.Date(2018, time.February, 22, 22, 24, 53, 0, time.UTC)
+		for i := 0; i < 10000; i++ {
+			tm = tm.Add(time.Duration(rng.Int63n(int64(w.resolution))))
+			if n := rng.Intn(3); n > 0 {
+				mr.Add(tm, n)
+				ref.Add(tm, n)
+				continue
+			}
+
+			got, want := mr.Rate(tm), ref.Rate(tm)
+			if math.Abs(got-want) > 1e-9*math.Abs(want) {
+				t.Fatalf("window %v/%v, step %d: mr.Rate() = %g, want %g", w.window, w.resolution, i, got, want)
+			}
+		}
+	}
+}
+
+func BenchmarkMovingRate(b *testing.B) {
+	b.Run("atomic", func(b *testing.B) {
+		mr := newMovingRate(defaultWindow, defaultResolution)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				t := time.Now()
+				mr.Add(t, 1)
+				mr.Rate(t)
+			}
+		})
+	})
+	b.Run("mutex", func(b *testing.B) {
+		mr := &lockedMovingRate{BucketLength: defaultResolution, BucketNum: 60}
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				t := time.Now()
+				mr.Add(t, 1)
+				mr.Rate(t)
+			}
+		})
+	})
+}
+
+func BenchmarkBudget(b *testing.B) {
+	b.Run("atomic", func(b *testing.B) {
+		budget := &Budget{Rate: 1, Ratio: 0.1}
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				budget.sendOK(i%2 == 1)
+			}
+		})
+	})
+	b.Run("mutex", func(b *testing.B) {
+		budget := &lockedBudget{Rate: 1, Ratio: 0.1}
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				budget.sendOK(i%2 == 1)
+			}
+		})
+	})
+}
+
+func TestBudgetStats(t *testing.T) {
+	var nilBudget *Budget
+	if got, want := nilBudget.Stats(), (BudgetStats{}); got != want {
+		t.Errorf("nil Budget: Stats() = %+v, want %+v", got, want)
+	}
+
+	b := &Budget{Ratio: 0.1}
+
+	if got, want := b.Stats(), (BudgetStats{}); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+
+	for i := 0; i < 10; i++ {
+		b.sendOK(false)
+	}
+	for i := 0; i < 5; i++ {
+		b.sendOK(true)
+	}
+
+	got := b.Stats()
+	t.Logf("Stats() = %+v", got)
+
+	if got.InitialRate <= 0 || got.RetryRate <= 0 {
+		t.Errorf("Stats() = %+v, want positive InitialRate and RetryRate", got)
+	}
+	if got.Ratio <= b.Ratio {
+		t.Errorf("Stats().Ratio = %g, want >%g", got.Ratio, b.Ratio)
+	}
+	if got, want := got.Refused, uint64(3); got != want {
+		t.Errorf("Stats().Refused = %d, want %d", got, want)
+	}
+	if !got.Exhausted {
+		t.Error("Stats().Exhausted = false, want true")
+	}
+
+	b = &Budget{Ratio: 0.1}
+	b.overload(false)
+	b.overload(true)
+	if got, want := b.Stats().Overloads, uint64(1); got != want {
+		t.Errorf("Stats().Overloads = %d, want %d", got, want)
+	}
+}
+
+func TestRatioMode(t *testing.T) {
+	cases := []struct {
+		initialRate, retriedRate float64
+		perInitial               float64
+	}{
+		{initialRate: 100, retriedRate: 0, perInitial: 0.1},
+		{initialRate: 100, retriedRate: 5, perInitial: 0.1},
+		{initialRate: 100, retriedRate: 10, perInitial: 0.1},
+		{initialRate: 100, retriedRate: 11, perInitial: 0.1},
+		{initialRate: 100, retriedRate: 20, perInitial: 0.25},
+		{initialRate: 100, retriedRate: 30, perInitial: 0.25},
+		{initialRate: 10, retriedRate: 10, perInitial: 1.0},
+		{initialRate: 10, retriedRate: 11, perInitial: 1.0},
+		{initialRate: 10, retriedRate: 25, perInitial: 3.0},
+	}
+
+	for _, c := range cases {
+		perTotal := PerTotalRatio(c.perInitial)
+		if got := PerInitialRatio(perTotal); math.Abs(got-c.perInitial) > 1e-9 {
+			t.Errorf("PerInitialRatio(PerTotalRatio(%g)) = %g, want %g", c.perInitial, got, c.perInitial)
+		}
+
+		bi := &Budget{Ratio: c.perInitial, RatioMode: RetriesPerInitial}
+		bt := &Budget{Ratio: perTotal, RatioMode: RetriesPerTotal}
+
+		want := c.retriedRate/c.initialRate > c.perInitial
+		for _, def := range []RatioMode{RetriesPerInitial, RetriesPerTotal} {
+			if got := bi.exceeded(c.initialRate, c.retriedRate, def); got != want {
+				t.Errorf("Budget{Ratio: %g, RatioMode: RetriesPerInitial}.exceeded(%g, %g) = %v, want %v",
+					bi.Ratio, c.initialRate, c.retriedRate, got, want)
+			}
+			if got := bt.exceeded(c.initialRate, c.retriedRate, def); got != want {
+				t.Errorf("Budget{Ratio: %g, RatioMode: RetriesPerTotal}.exceeded(%g, %g) = %v, want %v",
+					bt.Ratio, c.initialRate, c.retriedRate, got, want)
+			}
+		}
+	}
+}
+
+func TestRatioModeRate(t *testing.T) {
+	// Rate is compared to initial calls with RetriesPerInitial and to all
+	// calls with RetriesPerTotal.
+	cases := []struct {
+		initialRate, retriedRate float64
+		perInitial, perTotal     bool
+	}{
+		{initialRate: 40, retriedRate: 2, perInitial: false, perTotal: false},
+		{initialRate: 40, retriedRate: 10, perInitial: false, perTotal: false},
+		{initialRate: 45, retriedRate: 20, perInitial: false, perTotal: true},
+		{initialRate: 60, retriedRate: 5, perInitial: false, perTotal: false},
+		{initialRate: 60, retriedRate: 10, perInitial: true, perTotal: true},
+	}
+
+	bi := &Budget{Rate: 50, Ratio: 0.1, RatioMode: RetriesPerInitial}
+	bt := &Budget{Rate: 50, Ratio: PerTotalRatio(0.1), RatioMode: RetriesPerTotal}
+	for _, c := range cases {
+		if got := bi.exceeded(c.initialRate, c.retriedRate, DefaultRatioMode); got != c.perInitial {
+			t.Errorf("RetriesPerInitial: exceeded(%g, %g) = %v, want %v", c.initialRate, c.retriedRate, got, c.perInitial)
+		}
+		if got := bt.exceeded(c.initialRate, c.retriedRate, DefaultRatioMode); got != c.perTotal {
+			t.Errorf("RetriesPerTotal: exceeded(%g, %g) = %v, want %v", c.initialRate, c.retriedRate, got, c.perTotal)
+		}
+	}
+
+	// Converting Rate as documented yields the same threshold while the
+	// ratio is at the limit.
+	bt.Rate = bi.Rate * (1 + bi.Ratio)
+	for _, initialRate := range []float64{45, 49, 51, 55} {
+		retriedRate := initialRate * bi.Ratio * 1.0001
+		want := initialRate > bi.Rate
+		if got := bi.exceeded(initialRate, retriedRate, DefaultRatioMode); got != want {
+			t.Errorf("RetriesPerInitial: exceeded(%g, %g) = %v, want %v", initialRate, retriedRate, got, want)
+		}
+		if got := bt.exceeded(initialRate, retriedRate, DefaultRatioMode); got != want {
+			t.Errorf("RetriesPerTotal: exceeded(%g, %g) = %v, want %v", initialRate, retriedRate, got, want)
+		}
+	}
+}
+
+func TestBudgetStatsRatioMode(t *testing.T) {
+	// 18 retries for 100 initial calls: 0.18 retries per initial call,
+	// but only 0.15 retries per total call.
+	newBudget := func() *Budget {
+		b := &Budget{Rate: 1, Ratio: 0.16}
+		b.init()
+		now := time.Now()
+		b.initialCalls.Add(now, 100)
+		b.retriedCalls.Add(now, 18)
+		return b
+	}
+
+	client := newBudget()
+	if got := client.Stats(); !got.Exhausted || math.Abs(got.Ratio-0.18) > 1e-9 {
+		t.Errorf("client side: Stats() = %+v, want Ratio 0.18 and Exhausted", got)
+	}
+
+	server := newBudget()
+	server.overload(false)
+	if got := server.Stats(); got.Exhausted || math.Abs(got.Ratio-18.0/119.0) > 1e-9 {
+		t.Errorf("server side: Stats() = %+v, want Ratio %g and not Exhausted", got, 18.0/119.0)
+	}
+}
+
+func TestRatioModeDefault(t *testing.T) {
+	// 20 retries for 100 initial calls: 0.2 retries per initial call, but
+	// only 0.1667 retries per total call.
+	b := &Budget{Ratio: 0.18}
+
+	if got, want := b.exceeded(100, 20, RetriesPerInitial), true; got != want {
+		t.Errorf("client side: exceeded() = %v, want %v", got, want)
+	}
+	if got, want := b.exceeded(100, 20, RetriesPerTotal), false; got != want {
+		t.Errorf("server side: exceeded() = %v, want %v", got, want)
+	}
+
+	if err := (&Budget{Ratio: 1.5, RatioMode: RetriesPerTotal}).Validate(); err == nil {
+		t.Errorf("Validate() = nil, want error for a ratio of retries to total calls above 1.0")
+	}
+	if err := (&Budget{RatioMode: 42}).Validate(); err == nil {
+		t.Errorf("Validate() = nil, want error for an unknown RatioMode")
+	}
+}
@@ -0,0 +1,116 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// Dialer is a net.Dialer that retries failed connection attempts. Dialing is
+// retried via Do(), i.e. with backoff, and options such as Budget apply.
+//
+// The following errors are considered temporary:
+//
+// • Connections refused by the remote host (ECONNREFUSED), for example while
+// a backend restarts.
+//
+// • Unreachable hosts and networks (EHOSTUNREACH, ENETUNREACH).
+//
+// • Temporary DNS errors and DNS timeouts.
+//
+// • Timeouts, for example when Dialer.Timeout or the Timeout option expire.
+//
+// All other errors, for example hosts that do not exist, are permanent.
+//
+// Since no data is sent before the connection is established, retrying
+// connection attempts is safe even for non-idempotent requests. Use Dialer
+// with an http.Transport to retry connection establishment of all requests:
+//
+//	t := &http.Transport{
+//		DialContext: retry.NewDialer(retry.Attempts(3)).DialContext,
+//	}
+type Dialer struct {
+	net.Dialer
+
+	opts []Option
+}
+
+// NewDialer initializes a new Dialer with the provided options.
+func NewDialer(opts ...Option) *Dialer {
+	d := &Dialer{}
+	d.opts = append(d.opts, opts...)
+
+	return d
+}
+
+// Dial connects to the address on the named network. See net.Dial for a
+// description of the network and address parameters.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address on the named network using the
+// provided context. See net.Dialer.DialContext for details.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var (
+		mu   sync.Mutex
+		conn net.Conn
+		done bool
+	)
+
+	err := Do(ctx, func(ctx context.Context) error {
+		c, err := d.Dialer.DialContext(ctx, network, address)
+		if err != nil {
+			if dialRetryable(err) {
+				return temporaryError{err}
+			}
+			return Abort(err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		// Do() does not wait for cancelled attempts. Close connections
+		// established by them.
+		if done || ctx.Err() != nil {
+			c.Close()
+			return ctx.Err()
+		}
+		conn = c
+
+		return nil
+	}, d.opts...)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	done = true
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, unwrapTemporary(err)
+	}
+
+	return conn, nil
+}
+
+// dialRetryable reports whether the error returned by net.Dialer.DialContext
+// is temporary.
+func dialRetryable(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ENETUNREACH) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
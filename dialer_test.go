@@ -0,0 +1,156 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+)
+
+func ExampleDialer() {
+	c := &http.Client{
+		Transport: &http.Transport{
+			DialContext: NewDialer(Attempts(3)).DialContext,
+		},
+	}
+
+	// Establishing the connection is retried, even for POST requests.
+	res, err := c.Post("http://example.com/", "text/plain", nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+}
+
+// unusedAddr returns the address of a TCP port nobody listens on.
+func unusedAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	return addr
+}
+
+func TestDialer(t *testing.T) {
+	addr := unusedAddr(t)
+
+	var (
+		attempts int
+		l        net.Listener
+	)
+	d := NewDialer(rpcTestBackoff)
+	d.Control = func(_, _ string, _ syscall.RawConn) error {
+		attempts++
+		// The server starts listening during the third attempt.
+		if attempts == 3 {
+			var err error
+			if l, err = net.Listen("tcp", addr); err != nil {
+				t.Errorf("Listen(%q) = %v", addr, err)
+				return err
+			}
+		}
+		return nil
+	}
+
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() = %v", err)
+	}
+	conn.Close()
+	if l != nil {
+		l.Close()
+	}
+
+	if got, want := attempts, 3; got != want {
+		t.Errorf("attempts = %d, want %d", got, want)
+	}
+}
+
+func TestDialerRefused(t *testing.T) {
+	addr := unusedAddr(t)
+
+	var attempts int
+	d := NewDialer(rpcTestBackoff, Attempts(2))
+	d.Control = func(_, _ string, _ syscall.RawConn) error {
+		attempts++
+		return nil
+	}
+
+	if _, err := d.Dial("tcp", addr); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("Dial() = %v, want %v", err, syscall.ECONNREFUSED)
+	}
+	if got, want := attempts, 2; got != want {
+		t.Errorf("attempts = %d, want %d", got, want)
+	}
+
+	// Without retry budget, the connection attempt is not retried.
+	attempts = 0
+	d = NewDialer(rpcTestBackoff, &TokenBudget{})
+	d.Control = func(_, _ string, _ syscall.RawConn) error {
+		attempts++
+		return nil
+	}
+
+	if _, err := d.DialContext(context.Background(), "tcp", addr); !errors.Is(err, ErrExhausted) {
+		t.Errorf("Dial() = %v, want %v", err, ErrExhausted)
+	}
+	if got, want := attempts, 1; got != want {
+		t.Errorf("attempts = %d, want %d", got, want)
+	}
+}
+
+func TestDialRetryable(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{&net.OpError{Op: "dial", Err: syscall.EHOSTUNREACH}, true},
+		{&net.OpError{Op: "dial", Err: &net.DNSError{IsTemporary: true}}, true},
+		{&net.OpError{Op: "dial", Err: &net.DNSError{IsTimeout: true}}, true},
+		{&net.OpError{Op: "dial", Err: &net.DNSError{IsNotFound: true}}, false},
+		{&net.OpError{Op: "dial", Err: context.DeadlineExceeded}, true},
+		{&net.OpError{Op: "dial", Err: syscall.EACCES}, false},
+		{net.UnknownNetworkError("foo"), false},
+		{io.EOF, false},
+	}
+
+	for _, tc := range cases {
+		if got := dialRetryable(tc.err); got != tc.want {
+			t.Errorf("dialRetryable(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestDialerTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	c := &http.Client{
+		Transport: &http.Transport{
+			DialContext: NewDialer(rpcTestBackoff).DialContext,
+		},
+	}
+
+	res, err := c.Post(srv.URL, "text/plain", nil)
+	if err != nil {
+		t.Fatalf("Post() = %v", err)
+	}
+	defer res.Body.Close()
+
+	body, _ := io.ReadAll(res.Body)
+	if got, want := string(body), "ok"; got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,413 @@
+package retry
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The option types implement flag.Value and encoding.TextUnmarshaler, so that
+// they can be set from command line flags and configuration files. Use
+// RegisterFlags to add all options to a flag.FlagSet.
+
+// String returns the number of attempts as a decimal number.
+func (opt Attempts) String() string {
+	return strconv.Itoa(int(opt))
+}
+
+// Set parses s as a decimal number. It implements the flag.Value interface.
+func (opt *Attempts) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid attempts %q: want a non-negative integer", s)
+	}
+
+	*opt = Attempts(n)
+	return nil
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (opt Attempts) MarshalText() ([]byte, error) {
+	return []byte(opt.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (opt *Attempts) UnmarshalText(text []byte) error {
+	return opt.Set(string(text))
+}
+
+// String formats the backoff as "Base..Max*Factor", for example
+// "100ms..2s*2".
+func (b ExpBackoff) String() string {
+	return b.Base.String() + ".." + b.Max.String() + "*" + strconv.FormatFloat(b.Factor, 'g', -1, 64)
+}
+
+// Set parses the format returned by String. The factor may be omitted, in
+// which case it defaults to 2. It implements the flag.Value interface.
+func (b *ExpBackoff) Set(s string) error {
+	errInvalid := fmt.Errorf("invalid backoff %q: want base..max*factor, e.g. \"100ms..2s*2\"", s)
+
+	baseStr, rest, ok := strings.Cut(s, "..")
+	if !ok {
+		return errInvalid
+	}
+	maxStr, factorStr, hasFactor := strings.Cut(rest, "*")
+
+	base, err := time.ParseDuration(baseStr)
+	if err != nil || base < 0 {
+		return errInvalid
+	}
+	max, err := time.ParseDuration(maxStr)
+	if err != nil || max < base {
+		return errInvalid
+	}
+	factor := 2.0
+	if hasFactor {
+		if factor, err = strconv.ParseFloat(factorStr, 64); err != nil || !(factor > 0) {
+			return errInvalid
+		}
+	}
+
+	*b = ExpBackoff{
+		Base:   base,
+		Max:    max,
+		Factor: factor,
+	}
+	return nil
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (b ExpBackoff) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (b *ExpBackoff) UnmarshalText(text []byte) error {
+	return b.Set(string(text))
+}
+
+// String returns "full", "equal" and "none" for FullJitter, EqualJitter and
+// WithoutJitter respectively, and the decimal number otherwise.
+func (j Jitter) String() string {
+	switch j {
+	case FullJitter:
+		return "full"
+	case EqualJitter:
+		return "equal"
+	case WithoutJitter:
+		return "none"
+	}
+	return strconv.FormatFloat(float64(j), 'g', -1, 64)
+}
+
+// Set parses the format returned by String. It implements the flag.Value
+// interface.
+func (j *Jitter) Set(s string) error {
+	switch s {
+	case "full":
+		*j = FullJitter
+		return nil
+	case "equal":
+		*j = EqualJitter
+		return nil
+	case "none":
+		*j = WithoutJitter
+		return nil
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || !(f > 0 && f <= 1 || f == -1) {
+		return fmt.Errorf("invalid jitter %q: want \"full\", \"equal\", \"none\" or a number in (0,1]", s)
+	}
+
+	*j = Jitter(f)
+	return nil
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (j Jitter) MarshalText() ([]byte, error) {
+	return []byte(j.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (j *Jitter) UnmarshalText(text []byte) error {
+	return j.Set(string(text))
+}
+
+// String formats the timeout as a duration, for example "1.5s".
+func (opt Timeout) String() string {
+	return time.Duration(opt).String()
+}
+
+// Set parses a duration, for example "1.5s". It implements the flag.Value
+// interface.
+func (opt *Timeout) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return fmt.Errorf("invalid timeout %q: want a non-negative duration, e.g. \"1.5s\"", s)
+	}
+
+	*opt = Timeout(d)
+	return nil
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (opt Timeout) MarshalText() ([]byte, error) {
+	return []byte(opt.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (opt *Timeout) UnmarshalText(text []byte) error {
+	return opt.Set(string(text))
+}
+
+// String formats the settings of the budget as a comma separated list of
+// key=value pairs, for example "rate=10,ratio=0.1,window=1m0s". Settings
+// with a zero value are omitted. Store settings are not included.
+func (b *Budget) String() string {
+	if b == nil {
+		return ""
+	}
+
+	var kv []string
+	if b.Rate != 0 {
+		kv = append(kv, "rate="+strconv.FormatFloat(b.Rate, 'g', -1, 64))
+	}
+	if b.Ratio != 0 {
+		kv = append(kv, "ratio="+strconv.FormatFloat(b.Ratio, 'g', -1, 64))
+	}
+	switch b.RatioMode {
+	case RetriesPerInitial:
+		kv = append(kv, "mode=per-initial")
+	case RetriesPerTotal:
+		kv = append(kv, "mode=per-total")
+	}
+	if b.Window != 0 {
+		kv = append(kv, "window="+b.Window.String())
+	}
+	if b.Resolution != 0 {
+		kv = append(kv, "resolution="+b.Resolution.String())
+	}
+
+	return strings.Join(kv, ",")
+}
+
+// Set parses the format returned by String and sets the settings of the
+// budget. The keys are "rate", "ratio", "mode" ("per-initial" or
+// "per-total"), "window" and "resolution"; settings that are not specified
+// are reset to their zero value. Set must not be called after the budget has
+// been used. It implements the flag.Value interface.
+func (b *Budget) Set(s string) error {
+	var (
+		nb  Budget
+		err error
+	)
+
+	for _, field := range strings.Split(s, ",") {
+		if field == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return fmt.Errorf("invalid budget %q: want key=value, got %q", s, field)
+		}
+
+		switch key {
+		case "rate":
+			nb.Rate, err = strconv.ParseFloat(value, 64)
+		case "ratio":
+			nb.Ratio, err = strconv.ParseFloat(value, 64)
+		case "mode":
+			switch value {
+			case "per-initial":
+				nb.RatioMode = RetriesPerInitial
+			case "per-total":
+				nb.RatioMode = RetriesPerTotal
+			default:
+				err = fmt.Errorf("want \"per-initial\" or \"per-total\"")
+			}
+		case "window":
+			nb.Window, err = time.ParseDuration(value)
+		case "resolution":
+			nb.Resolution, err = time.ParseDuration(value)
+		default:
+			err = fmt.Errorf("unknown key")
+		}
+		if err != nil {
+			return fmt.Errorf("invalid budget %q: %s: %w", s, key, err)
+		}
+	}
+
+	if err := nb.Validate(); err != nil {
+		return err
+	}
+
+	b.Rate = nb.Rate
+	b.Ratio = nb.Ratio
+	b.RatioMode = nb.RatioMode
+	b.Window = nb.Window
+	b.Resolution = nb.Resolution
+	return nil
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (b *Budget) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (b *Budget) UnmarshalText(text []byte) error {
+	return b.Set(string(text))
+}
+
+// Flags holds retry options set via command line flags or environment
+// variables. Use RegisterFlags to create Flags.
+type Flags struct {
+	Attempts Attempts
+	Backoff  ExpBackoff
+	Jitter   Jitter
+	Timeout  Timeout
+	Budget   Budget
+
+	// set holds the names of the options that have been set.
+	set map[string]bool
+}
+
+// flagValue records when a flag has been set.
+type flagValue struct {
+	flag.Value
+	name  string
+	flags *Flags
+}
+
+// String returns the value of the option. flag.PrintDefaults calls String on
+// a zero flagValue to detect default values, so String must not rely on the
+// embedded Value being set.
+func (v *flagValue) String() string {
+	if v == nil || v.Value == nil {
+		return ""
+	}
+	return v.Value.String()
+}
+
+func (v *flagValue) Set(s string) error {
+	if err := v.Value.Set(s); err != nil {
+		return err
+	}
+
+	v.flags.set[v.name] = true
+	return nil
+}
+
+// values returns the options of f by name. The names are used for flags and,
+// in upper case, for environment variables.
+func (f *Flags) values() []*flagValue {
+	return []*flagValue{
+		{&f.Attempts, "attempts", f},
+		{&f.Backoff, "backoff", f},
+		{&f.Jitter, "jitter", f},
+		{&f.Timeout, "timeout", f},
+		{&f.Budget, "budget", f},
+	}
+}
+
+var flagUsage = map[string]string{
+	"attempts": "maximum number of attempts; 0 retries indefinitely",
+	"backoff":  "exponential backoff as base..max*factor",
+	"jitter":   `backoff jitter: "full", "equal", "none" or a number in (0,1]`,
+	"timeout":  "timeout of each attempt; 0 disables the timeout",
+	"budget":   "retry budget as comma separated key=value pairs, e.g. rate=10,ratio=0.1",
+}
+
+// RegisterFlags registers flags for all retry options with fs. The flags are
+// named prefix followed by "attempts", "backoff", "jitter", "timeout" and
+// "budget", for example:
+//
+//	f := retry.RegisterFlags(flag.CommandLine, "retry-")
+//	flag.Parse()
+//	err := retry.Do(ctx, cb, f.Options()...)
+//
+// allows to set the backoff with "--retry-backoff=100ms..2s*2". The flags
+// default to the defaults of Do().
+func RegisterFlags(fs *flag.FlagSet, prefix string) *Flags {
+	f := newFlags()
+
+	for _, v := range f.values() {
+		fs.Var(v, prefix+v.name, flagUsage[v.name])
+	}
+
+	return f
+}
+
+func newFlags() *Flags {
+	opts := newOptions(nil)
+
+	return &Flags{
+		Attempts: opts.Attempts,
+		Backoff:  opts.backoff.(ExpBackoff),
+		Jitter:   opts.Jitter,
+		set:      make(map[string]bool),
+	}
+}
+
+// ReadEnv sets the options from environment variables named prefix followed
+// by "ATTEMPTS", "BACKOFF", "JITTER", "TIMEOUT" and "BUDGET", for example
+// "RETRY_BACKOFF=100ms..2s*2" with the "RETRY_" prefix. The values use the
+// same format as the flags. Call ReadEnv before parsing the flags, so that
+// flags override environment variables.
+func (f *Flags) ReadEnv(prefix string) error {
+	for _, v := range f.values() {
+		name := prefix + strings.ToUpper(v.name)
+
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := v.Set(s); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Options returns the options that have been set via flags or environment
+// variables. Options that have not been set are omitted, so that the defaults
+// of Do() apply.
+func (f *Flags) Options() []Option {
+	var opts []Option
+
+	if f.set["attempts"] {
+		opts = append(opts, f.Attempts)
+	}
+	if f.set["backoff"] {
+		opts = append(opts, f.Backoff)
+	}
+	if f.set["jitter"] {
+		opts = append(opts, f.Jitter)
+	}
+	if f.set["timeout"] {
+		opts = append(opts, f.Timeout)
+	}
+	if f.set["budget"] {
+		opts = append(opts, &f.Budget)
+	}
+
+	return opts
+}
+
+// EnvOptions returns the options set by environment variables named prefix
+// followed by "ATTEMPTS", "BACKOFF", "JITTER", "TIMEOUT" and "BUDGET". See
+// Flags.ReadEnv for details.
+func EnvOptions(prefix string) ([]Option, error) {
+	f := newFlags()
+	if err := f.ReadEnv(prefix); err != nil {
+		return nil, err
+	}
+
+	return f.Options(), nil
+}
@@ -0,0 +1,185 @@
+package retry
+
+import (
+	"context"
+	"flag"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func ExampleRegisterFlags() {
+	fs := flag.NewFlagSet("example", flag.ExitOnError)
+	f := RegisterFlags(fs, "retry-")
+
+	// Environment variables, e.g. RETRY_ATTEMPTS=3, provide defaults that
+	// can be overridden by flags.
+	if err := f.ReadEnv("RETRY_"); err != nil {
+		panic(err)
+	}
+	fs.Parse([]string{"--retry-backoff=100ms..2s*2", "--retry-budget=rate=10,ratio=0.1"})
+
+	_ = Do(context.Background(), func(context.Context) error {
+		return nil
+	}, f.Options()...)
+}
+
+func TestOptionText(t *testing.T) {
+	cases := []struct {
+		value interface {
+			flag.Value
+			MarshalText() ([]byte, error)
+		}
+		text string
+	}{
+		{new(Attempts), "3"},
+		{new(ExpBackoff), "100ms..2s*2"},
+		{new(ExpBackoff), "1s..1m0s*1.5"},
+		{new(Jitter), "full"},
+		{new(Jitter), "equal"},
+		{new(Jitter), "none"},
+		{new(Jitter), "0.2"},
+		{new(Timeout), "1.5s"},
+		{new(Budget), "rate=10,ratio=0.1"},
+		{new(Budget), "rate=5,ratio=0.5,mode=per-total,window=10s,resolution=100ms"},
+	}
+
+	for _, tc := range cases {
+		if err := tc.value.Set(tc.text); err != nil {
+			t.Errorf("Set(%q) = %v", tc.text, err)
+			continue
+		}
+		if got := tc.value.String(); got != tc.text {
+			t.Errorf("Set(%q); String() = %q", tc.text, got)
+		}
+		if got, err := tc.value.MarshalText(); err != nil || string(got) != tc.text {
+			t.Errorf("Set(%q); MarshalText() = (%q, %v)", tc.text, got, err)
+		}
+	}
+
+	var b ExpBackoff
+	if err := b.UnmarshalText([]byte("10ms..1s")); err != nil {
+		t.Fatal(err)
+	}
+	if want := (ExpBackoff{Base: 10 * time.Millisecond, Max: time.Second, Factor: 2}); b != want {
+		t.Errorf("UnmarshalText(%q) = %+v, want %+v", "10ms..1s", b, want)
+	}
+}
+
+func TestOptionTextErrors(t *testing.T) {
+	cases := []struct {
+		value flag.Value
+		text  string
+	}{
+		{new(Attempts), "-1"},
+		{new(Attempts), "many"},
+		{new(ExpBackoff), "100ms"},
+		{new(ExpBackoff), "2s..1s"},
+		{new(ExpBackoff), "100ms..2s*0"},
+		{new(ExpBackoff), "fast..slow"},
+		{new(Jitter), "0"},
+		{new(Jitter), "1.5"},
+		{new(Jitter), "some"},
+		{new(Timeout), "-1s"},
+		{new(Timeout), "1"},
+		{new(Budget), "rate"},
+		{new(Budget), "rate=ten"},
+		{new(Budget), "ratio=-1"},
+		{new(Budget), "mode=sometimes"},
+		{new(Budget), "color=blue"},
+	}
+
+	for _, tc := range cases {
+		if err := tc.value.Set(tc.text); err == nil {
+			t.Errorf("%T.Set(%q) succeeded, want error", tc.value, tc.text)
+		}
+	}
+}
+
+func TestRegisterFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	f := RegisterFlags(fs, "retry-")
+
+	if got := f.Options(); len(got) != 0 {
+		t.Errorf("Options() = %v, want no options before parsing", got)
+	}
+
+	err := fs.Parse([]string{
+		"--retry-attempts=3",
+		"--retry-backoff=10ms..1s*3",
+		"--retry-timeout=2s",
+	})
+	if err != nil {
+		t.Fatalf("Parse() = %v", err)
+	}
+
+	want := []Option{
+		Attempts(3),
+		ExpBackoff{Base: 10 * time.Millisecond, Max: time.Second, Factor: 3},
+		Timeout(2 * time.Second),
+	}
+	if got := f.Options(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Options() = %#v, want %#v", got, want)
+	}
+
+	if err := fs.Parse([]string{"--retry-jitter=half"}); err == nil {
+		t.Error("Parse(--retry-jitter=half) succeeded, want error")
+	}
+
+	// The defaults of Do() are shown in the usage.
+	if got, want := fs.Lookup("retry-attempts").DefValue, "4"; got != want {
+		t.Errorf("DefValue = %q, want %q", got, want)
+	}
+
+	var usage strings.Builder
+	fs.SetOutput(&usage)
+	fs.PrintDefaults()
+	for _, want := range []string{"-retry-attempts", "(default 4)", "-retry-budget"} {
+		if !strings.Contains(usage.String(), want) {
+			t.Errorf("PrintDefaults() = %q, want it to contain %q", usage.String(), want)
+		}
+	}
+	if strings.Contains(usage.String(), "panic") {
+		t.Errorf("PrintDefaults() = %q, want no panic", usage.String())
+	}
+}
+
+func TestReadEnv(t *testing.T) {
+	t.Setenv("RETRY_ATTEMPTS", "7")
+	t.Setenv("RETRY_BUDGET", "rate=2,ratio=0.2")
+
+	opts, err := EnvOptions("RETRY_")
+	if err != nil {
+		t.Fatalf("EnvOptions() = %v", err)
+	}
+	if len(opts) != 2 {
+		t.Fatalf("EnvOptions() = %v, want two options", opts)
+	}
+	if got, want := opts[0], Attempts(7); got != want {
+		t.Errorf("opts[0] = %v, want %v", got, want)
+	}
+	if b, ok := opts[1].(*Budget); !ok || b.Rate != 2 || b.Ratio != 0.2 {
+		t.Errorf("opts[1] = %v, want budget with rate=2,ratio=0.2", opts[1])
+	}
+
+	// Flags override environment variables.
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	f := RegisterFlags(fs, "")
+	if err := f.ReadEnv("RETRY_"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Parse([]string{"-attempts=2"}); err != nil {
+		t.Fatal(err)
+	}
+	if f.Attempts != 2 {
+		t.Errorf("Attempts = %v, want 2", f.Attempts)
+	}
+
+	t.Setenv("RETRY_JITTER", "lots")
+	if _, err := EnvOptions("RETRY_"); err == nil || !strings.Contains(err.Error(), "RETRY_JITTER") {
+		t.Errorf("EnvOptions() = %v, want error mentioning RETRY_JITTER", err)
+	}
+}
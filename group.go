@@ -0,0 +1,108 @@
+package retry
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+)
+
+// BudgetGroup is a set of retry budgets, one per backend. Budgets are created
+// lazily from Template when a key is first seen. When more than MaxKeys
+// budgets exist, the least recently used budget is evicted.
+//
+// When passed to NewTransport(), the Transport uses a separate Budget for each
+// host, so that a single failing backend does not exhaust the retry budget of
+// all the healthy ones. Do() has no request to derive a key from and returns
+// ErrTransportOnly; use BudgetGroup.Budget() to pick a Budget for Do().
+//
+// Implements the Option interface.
+type BudgetGroup struct {
+	// Template holds the settings of newly created budgets: Rate, Ratio,
+	// RatioMode, Window, Resolution, Store and SyncInterval are copied. If
+	// Store is set, the StoreKey of each budget is Template.StoreKey, a
+	// slash, and the key.
+	Template Budget
+
+	// Key returns the key of the budget used for req. Defaults to the
+	// request's host, req.URL.Host.
+	Key func(req *http.Request) string
+
+	// MaxKeys is the maximum number of budgets in the group. Defaults to
+	// 100.
+	MaxKeys int
+
+	mu      sync.Mutex
+	lru     list.List // of *groupEntry, most recently used first
+	budgets map[string]*list.Element
+}
+
+type groupEntry struct {
+	key    string
+	budget *Budget
+}
+
+func (g *BudgetGroup) apply(opts *internalOptions) {
+	opts.budgetGroup = g
+}
+
+func (g *BudgetGroup) key(req *http.Request) string {
+	if g.Key != nil {
+		return g.Key(req)
+	}
+	return req.URL.Host
+}
+
+func (g *BudgetGroup) maxKeys() int {
+	if g.MaxKeys <= 0 {
+		return 100
+	}
+	return g.MaxKeys
+}
+
+// Budget returns the budget for key, creating it if necessary.
+func (g *BudgetGroup) Budget(key string) *Budget {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if e, ok := g.budgets[key]; ok {
+		g.lru.MoveToFront(e)
+		return e.Value.(*groupEntry).budget
+	}
+
+	b := &Budget{
+		Rate:         g.Template.Rate,
+		Ratio:        g.Template.Ratio,
+		RatioMode:    g.Template.RatioMode,
+		Window:       g.Template.Window,
+		Resolution:   g.Template.Resolution,
+		Store:        g.Template.Store,
+		SyncInterval: g.Template.SyncInterval,
+	}
+	if b.Store != nil {
+		b.StoreKey = g.Template.StoreKey + "/" + key
+	}
+
+	if g.budgets == nil {
+		g.budgets = make(map[string]*list.Element)
+	}
+	g.budgets[key] = g.lru.PushFront(&groupEntry{
+		key:    key,
+		budget: b,
+	})
+
+	for g.lru.Len() > g.maxKeys() {
+		e := g.lru.Back()
+		g.lru.Remove(e)
+		delete(g.budgets, e.Value.(*groupEntry).key)
+	}
+
+	return b
+}
+
+// Len returns the number of budgets in the group.
+func (g *BudgetGroup) Len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.lru.Len()
+}
@@ -0,0 +1,136 @@
+package retry
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func ExampleBudgetGroup() {
+	c := &http.Client{
+		// Each host gets its own retry budget, so that one failing
+		// backend does not exhaust retries for all others.
+		Transport: NewTransport(http.DefaultTransport, &BudgetGroup{
+			Template: Budget{
+				Rate:  1.0,
+				Ratio: 0.1,
+			},
+			MaxKeys: 1000,
+		}),
+	}
+
+	res, err := c.Get("http://example.com/")
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	// use "res"
+}
+
+func TestBudgetGroup(t *testing.T) {
+	store := &MemoryBudgetStore{}
+	g := &BudgetGroup{
+		Template: Budget{
+			Ratio:     0.1,
+			RatioMode: RetriesPerTotal,
+			Store:     store,
+			StoreKey:  "backends",
+		},
+		MaxKeys: 2,
+	}
+
+	a := g.Budget("a")
+	if got, want := a.Ratio, 0.1; got != want {
+		t.Errorf("Budget(\"a\").Ratio = %g, want %g", got, want)
+	}
+	if got, want := a.RatioMode, RetriesPerTotal; got != want {
+		t.Errorf("Budget(\"a\").RatioMode = %d, want %d", got, want)
+	}
+	if got, want := a.StoreKey, "backends/a"; got != want {
+		t.Errorf("Budget(\"a\").StoreKey = %q, want %q", got, want)
+	}
+
+	b := g.Budget("b")
+	if got := g.Budget("a"); got != a {
+		t.Errorf("Budget(\"a\") returned a new budget, want the existing one")
+	}
+
+	// "b" is the least recently used key and gets evicted.
+	g.Budget("c")
+	if got, want := g.Len(), 2; got != want {
+		t.Errorf("Len() = %d, want %d", got, want)
+	}
+	if got := g.Budget("a"); got != a {
+		t.Errorf("Budget(\"a\") returned a new budget, want the existing one")
+	}
+	if got := g.Budget("b"); got == b {
+		t.Errorf("Budget(\"b\") returned the evicted budget, want a new one")
+	}
+}
+
+// hostTransport fails all requests to host "bad". Requests to all other hosts
+// fail on every other call.
+type hostTransport struct {
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.calls == nil {
+		t.calls = make(map[string]int)
+	}
+	t.calls[req.URL.Host]++
+
+	status := http.StatusOK
+	if req.URL.Host == "bad" || t.calls[req.URL.Host]%2 == 1 {
+		status = http.StatusServiceUnavailable
+	}
+
+	return &http.Response{
+		Status:     http.StatusText(status),
+		StatusCode: status,
+		Body:       http.NoBody,
+		Request:    req,
+	}, nil
+}
+
+func TestTransportBudgetGroup(t *testing.T) {
+	g := &BudgetGroup{
+		Template: Budget{Ratio: 0.1},
+	}
+	backoff := ExpBackoff{
+		Base:   time.Millisecond,
+		Max:    time.Millisecond,
+		Factor: 1.0,
+	}
+	c := &http.Client{
+		Transport: NewTransport(&hostTransport{}, g, backoff, Attempts(2)),
+	}
+
+	var exhausted bool
+	for i := 0; i < 5; i++ {
+		_, err := c.Get("http://bad/")
+		if errors.Is(err, ErrExhausted) {
+			exhausted = true
+		}
+	}
+	if !exhausted {
+		t.Fatal("the retry budget of host \"bad\" is not exhausted")
+	}
+
+	res, err := c.Get("http://good/")
+	if err != nil {
+		t.Fatalf("Get(\"http://good/\") = %v, want success", err)
+	}
+	res.Body.Close()
+
+	if got, want := g.Len(), 2; got != want {
+		t.Errorf("Len() = %d, want %d", got, want)
+	}
+}
@@ -3,9 +3,9 @@ package retry
 import (
 	"bytes"
 	"context"
-	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"strconv"
 )
@@ -48,6 +48,9 @@ import (
 //
 // Use "net/http".Request.WithContext() to pass a context to Do(). By default,
 // the request is associated with the background context.
+//
+// Statistics about the call, such as the number of attempts, are available
+// from the context of the response's request, see ContextStats().
 type Transport struct {
 	http.RoundTripper
 
@@ -76,6 +79,22 @@ func permanentErrorCode(c int) bool {
 		c == http.StatusNotImplemented
 }
 
+// RetryableStatusCodes is the set of HTTP status codes retried by Transport.
+// When set, responses with one of these status codes are retried and all
+// other responses are returned to the caller, replacing the default rules
+// described in the documentation of Transport. The "Retry-After" header is
+// ignored in this case.
+//
+// Other errors have no status code, so Do() returns ErrTransportOnly when
+// passed this option.
+//
+// Implements the Option interface.
+type RetryableStatusCodes []int
+
+func (opt RetryableStatusCodes) apply(opts *internalOptions) {
+	opts.retryableStatusCodes = opt
+}
+
 // checkResponse checks the HTTP response for retryable errors.
 //
 // Temporary errors are returned as an error and are therefore retried.
@@ -84,8 +103,11 @@ func permanentErrorCode(c int) bool {
 // An argument could be made to return them as a permanent error, too.
 // However, this would mean a significant diversion from the standard net/http semantic.
 //
+// If codes is not nil, only responses with one of these status codes are
+// retried.
+//
 // If err is not nil, it is wrapped in permanentError and returned.
-func checkResponse(res *http.Response, err error) error {
+func checkResponse(res *http.Response, err error, codes RetryableStatusCodes) error {
 	if err != nil {
 		if _, ok := err.(Error); ok {
 			return err
@@ -93,18 +115,50 @@ func checkResponse(res *http.Response, err error) error {
 		return Abort(err)
 	}
 
+	if codes != nil {
+		for _, c := range codes {
+			if res.StatusCode == c {
+				return newStatusError(res)
+			}
+		}
+		return nil
+	}
+
 	if temporaryErrorCode(res.StatusCode) {
-		return errors.New(res.Status)
+		return newStatusError(res)
 	} else if permanentErrorCode(res.StatusCode) {
 		if _, ok := res.Header["Retry-After"]; ok {
 			// temporary condition, retry
-			return errors.New(res.Status)
+			return newStatusError(res)
 		}
 	}
 
 	return nil
 }
 
+// statusError is the error returned for responses with a retryable status
+// code.
+type statusError struct {
+	code   int
+	status string
+}
+
+func newStatusError(res *http.Response) statusError {
+	status := res.Status
+	if status == "" {
+		status = strconv.Itoa(res.StatusCode) + " " + http.StatusText(res.StatusCode)
+	}
+
+	return statusError{
+		code:   res.StatusCode,
+		status: status,
+	}
+}
+
+func (e statusError) Error() string {
+	return e.status
+}
+
 // RoundTrip implements a retrying "net/http".RoundTripper.
 func (t Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	if req.Body != nil {
@@ -114,14 +168,32 @@ func (t Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	var (
 		body     = seekableBody(req)
 		response *http.Response
+		opts     = newOptions(t.opts)
 	)
 
-	err := Do(req.Context(), func(ctx context.Context) error {
-		rt := t.RoundTripper
-		if rt == nil {
-			rt = http.DefaultTransport
-		}
+	if opts.budgetGroup != nil {
+		opts.budget = opts.budgetGroup.Budget(opts.budgetGroup.key(req))
+	}
+	if trace := ContextRetryTrace(req.Context()); trace != nil {
+		opts.observers = append(opts.observers, trace)
+	}
 
+	rt := t.RoundTripper
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	ctx := withTraceName(req.Context(), "retry.Transport")
+	ctx = withLogAttrs(ctx,
+		slog.String("method", req.Method),
+		slog.String("host", req.URL.Host))
+
+	// The statistics cover the call made by RoundTrip, not the requests
+	// made to resume the response body.
+	callOpts := opts
+	callOpts.observers = append(opts.observers[:len(opts.observers):len(opts.observers)], &statsRecorder{})
+
+	err := do(ctx, func(ctx context.Context) error {
 		if body != nil {
 			if _, err := body.Seek(0, io.SeekStart); err != nil {
 				return fmt.Errorf("rewinding request body: %w", err)
@@ -134,20 +206,32 @@ func (t Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 			req.Header.Set("Retry-Attempt", strconv.Itoa(a))
 		}
 
-		res, err := rt.RoundTrip(req.WithContext(ctx))
-		if err := checkResponse(res, err); err != nil {
+		attemptReq := req.WithContext(ctx)
+		res, err := rt.RoundTrip(attemptReq)
+		if res != nil {
+			setAttemptStatus(ctx, res.StatusCode)
+			// ContextStats() relies on the response's request.
+			if res.Request == nil {
+				res.Request = attemptReq
+			}
+		}
+		if err := checkResponse(res, err, opts.retryableStatusCodes); err != nil {
 			return err
 		}
 
 		response = res
 
 		return nil
-	}, t.opts...)
+	}, callOpts)
 
 	if err != nil {
 		return nil, err
 	}
 
+	if opts.resumable {
+		response.Body = newResumableBody(rt, req, response, opts)
+	}
+
 	return response, nil
 }
 
@@ -201,8 +285,14 @@ type BudgetHandler struct {
 
 	// Budget is the server side retry budget. While Handler is handling
 	// fewer than Budget.Rate requests, responses are never modified. If
-	// the ratio of retries to total requests exceeds Budget.Ratio, this is
-	// taken as an indicator that the cluster as a whole is overloaded.
+	// the ratio of retries exceeds Budget.Ratio, this is taken as an
+	// indicator that the cluster as a whole is overloaded. Unless
+	// Budget.RatioMode is set, the ratio is calculated as retries to
+	// total requests.
+	//
+	// If Budget is invalid, see Budget.Validate, every request is handled
+	// as if in overload, and Budget.Stats reports the error in
+	// BudgetStats.Err.
 	Budget
 }
 
@@ -213,6 +303,7 @@ func (h *BudgetHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if h.overload(isRetry) {
 		h.Handler.ServeHTTP(&overloadResponseWriter{
 			ResponseWriter: w,
+			budget:         &h.Budget,
 		}, req)
 	} else {
 		h.Handler.ServeHTTP(w, req)
@@ -221,12 +312,14 @@ func (h *BudgetHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 type overloadResponseWriter struct {
 	http.ResponseWriter
+	budget *Budget
 }
 
 func (w *overloadResponseWriter) WriteHeader(statusCode int) {
 	w.Header().Del("Retry-After")
 	if temporaryErrorCode(statusCode) {
 		statusCode = http.StatusTooManyRequests
+		w.budget.rewrites.Add(1)
 	}
 
 	w.ResponseWriter.WriteHeader(statusCode)
@@ -8,6 +8,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strconv"
 	"strings"
@@ -322,3 +323,28 @@ func testBudgetHandler(t *testing.T, ratio float64, wantStatus int) {
 		t.Errorf("responsesByStatus[%d] = %d, want %d", wantStatus, got, want)
 	}
 }
+
+func TestBudgetHandlerInvalid(t *testing.T) {
+	h := &BudgetHandler{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}),
+		Budget: Budget{Ratio: -1},
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+
+	// An invalid budget fails closed, i.e. signals overload.
+	if got, want := rec.Code, http.StatusTooManyRequests; got != want {
+		t.Errorf("status = %d, want %d", got, want)
+	}
+
+	stats := h.Stats()
+	if stats.Err == nil {
+		t.Error("Stats().Err = nil, want error")
+	}
+	if got, want := stats.Overloads, uint64(1); got != want {
+		t.Errorf("Stats().Overloads = %d, want %d", got, want)
+	}
+}
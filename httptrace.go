@@ -0,0 +1,160 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// RetryTrace is a set of hooks run at the stages of a request retried by
+// Transport. It is the companion of "net/http/httptrace".ClientTrace: when
+// Transport retries a request, the hooks of a ClientTrace fire for every
+// attempt, and RetryTrace tells which attempt the events belong to. Any
+// particular hook may be nil.
+//
+// Attempts are made sequentially, so ClientTrace events observed between
+// AttemptStart and AttemptDone belong to that attempt. Within ClientTrace
+// hooks, the attempt is also available from the request's context via
+// Attempt().
+//
+// Use WithRetryTrace to attach a RetryTrace to a request's context.
+type RetryTrace struct {
+	// AttemptStart is called before an attempt is made. attempt is the
+	// zero-based index of the attempt, see Attempt().
+	AttemptStart func(attempt int)
+
+	// AttemptDone is called after an attempt has completed.
+	AttemptDone func(info AttemptDoneInfo)
+
+	// BackoffStart is called before Transport pauses after the failed
+	// attempt with index attempt.
+	BackoffStart func(attempt int, delay time.Duration)
+
+	// GiveUp is called when the request fails, for example because all
+	// attempts failed or the retry budget is exhausted. attempts is the
+	// number of attempts made.
+	GiveUp func(attempts int, err error)
+}
+
+// AttemptDoneInfo is the argument of RetryTrace.AttemptDone.
+type AttemptDoneInfo struct {
+	// Attempt is the zero-based index of the attempt.
+	Attempt int
+
+	// StatusCode is the status code of the response, or zero if no
+	// response has been received.
+	StatusCode int
+
+	// Err is the error of the attempt, e.g. a network error or the
+	// error returned for a retryable status code. It is nil if the
+	// attempt succeeded.
+	Err error
+}
+
+type retryTraceKey struct{}
+
+// WithRetryTrace returns a new context based on the provided parent ctx.
+// Requests made by Transport with the returned context use the provided trace
+// hooks, in addition to any previous hooks registered with ctx. Hooks
+// defined in the provided trace are called first.
+func WithRetryTrace(ctx context.Context, trace *RetryTrace) context.Context {
+	if trace == nil {
+		panic("nil trace")
+	}
+
+	if old := ContextRetryTrace(ctx); old != nil {
+		trace = trace.compose(old)
+	}
+
+	return context.WithValue(ctx, retryTraceKey{}, trace)
+}
+
+// ContextRetryTrace returns the RetryTrace associated with the provided
+// context. If none, it returns nil.
+func ContextRetryTrace(ctx context.Context) *RetryTrace {
+	trace, _ := ctx.Value(retryTraceKey{}).(*RetryTrace)
+	return trace
+}
+
+// compose returns a RetryTrace calling the hooks of t and then the hooks of
+// old.
+func (t *RetryTrace) compose(old *RetryTrace) *RetryTrace {
+	return &RetryTrace{
+		AttemptStart: func(attempt int) {
+			if t.AttemptStart != nil {
+				t.AttemptStart(attempt)
+			}
+			if old.AttemptStart != nil {
+				old.AttemptStart(attempt)
+			}
+		},
+		AttemptDone: func(info AttemptDoneInfo) {
+			if t.AttemptDone != nil {
+				t.AttemptDone(info)
+			}
+			if old.AttemptDone != nil {
+				old.AttemptDone(info)
+			}
+		},
+		BackoffStart: func(attempt int, delay time.Duration) {
+			if t.BackoffStart != nil {
+				t.BackoffStart(attempt, delay)
+			}
+			if old.BackoffStart != nil {
+				old.BackoffStart(attempt, delay)
+			}
+		},
+		GiveUp: func(attempts int, err error) {
+			if t.GiveUp != nil {
+				t.GiveUp(attempts, err)
+			}
+			if old.GiveUp != nil {
+				old.GiveUp(attempts, err)
+			}
+		},
+	}
+}
+
+func (t *RetryTrace) start(ctx context.Context) context.Context {
+	return ctx
+}
+
+func (t *RetryTrace) attempt(ctx context.Context, attempt int) (context.Context, func(error)) {
+	if t.AttemptStart != nil {
+		t.AttemptStart(attempt)
+	}
+
+	return ctx, func(err error) {
+		if t.AttemptDone == nil {
+			return
+		}
+
+		info := AttemptDoneInfo{
+			Attempt: attempt,
+			Err:     err,
+		}
+		if s := attemptFromContext(ctx); s != nil {
+			info.StatusCode = int(s.status.Load())
+		}
+
+		// Unwrap errors marked as permanent by Transport.
+		var p permanentError
+		if errors.As(err, &p) {
+			info.Err = p.error
+		}
+
+		t.AttemptDone(info)
+	}
+}
+
+func (t *RetryTrace) backoff(_ context.Context, attempt int, _ error, delay time.Duration) {
+	if t.BackoffStart != nil {
+		t.BackoffStart(attempt, delay)
+	}
+}
+
+func (t *RetryTrace) done(_ context.Context, attempts int, err error) {
+	if err != nil && t.GiveUp != nil {
+		t.GiveUp(attempts, err)
+	}
+}
@@ -0,0 +1,147 @@
+package retry
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func ExampleWithRetryTrace() {
+	var attempt int
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			log.Printf("attempt %d: got connection, reused: %v", attempt, info.Reused)
+		},
+	})
+	ctx = WithRetryTrace(ctx, &RetryTrace{
+		AttemptStart: func(a int) {
+			attempt = a
+		},
+		AttemptDone: func(info AttemptDoneInfo) {
+			log.Printf("attempt %d: status %d, error %v", info.Attempt, info.StatusCode, info.Err)
+		},
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com/", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	c := &http.Client{
+		Transport: &Transport{},
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer res.Body.Close()
+}
+
+// traceEvents returns a RetryTrace appending events to *events.
+func traceEvents(prefix string, events *[]string) *RetryTrace {
+	return &RetryTrace{
+		AttemptStart: func(attempt int) {
+			*events = append(*events, fmt.Sprintf("%sAttemptStart(%d)", prefix, attempt))
+		},
+		AttemptDone: func(info AttemptDoneInfo) {
+			*events = append(*events, fmt.Sprintf("%sAttemptDone(%d, %d, %v)", prefix, info.Attempt, info.StatusCode, info.Err))
+		},
+		BackoffStart: func(attempt int, delay time.Duration) {
+			*events = append(*events, fmt.Sprintf("%sBackoffStart(%d, %v)", prefix, attempt, delay))
+		},
+		GiveUp: func(attempts int, err error) {
+			*events = append(*events, fmt.Sprintf("%sGiveUp(%d, %v)", prefix, attempts, err))
+		},
+	}
+}
+
+func TestRetryTrace(t *testing.T) {
+	cases := []struct {
+		status []int
+		want   []string
+	}{
+		{
+			status: []int{503, 200},
+			want: []string{
+				"AttemptStart(0)",
+				"AttemptDone(0, 503, 503 Service Unavailable)",
+				"BackoffStart(0, 1ms)",
+				"AttemptStart(1)",
+				"AttemptDone(1, 200, <nil>)",
+			},
+		},
+		{
+			status: []int{500, 502},
+			want: []string{
+				"AttemptStart(0)",
+				"AttemptDone(0, 500, 500 Internal Server Error)",
+				"BackoffStart(0, 1ms)",
+				"AttemptStart(1)",
+				"AttemptDone(1, 502, 502 Bad Gateway)",
+				"BackoffStart(1, 1ms)",
+				"GiveUp(2, 502 Bad Gateway)",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		var events []string
+		ctx := WithRetryTrace(context.Background(), traceEvents("", &events))
+
+		c := &http.Client{
+			Transport: NewTransport(&testTransport{status: tc.status},
+				Attempts(2), rpcTestBackoff, WithoutJitter),
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://example.com/", strings.NewReader("request payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res, err := c.Do(req); err == nil {
+			res.Body.Close()
+		}
+
+		if !reflect.DeepEqual(events, tc.want) {
+			t.Errorf("status %v: events = %q, want %q", tc.status, events, tc.want)
+		}
+	}
+}
+
+func TestRetryTraceCompose(t *testing.T) {
+	var events []string
+
+	ctx := WithRetryTrace(context.Background(), traceEvents("outer.", &events))
+	ctx = WithRetryTrace(ctx, &RetryTrace{
+		AttemptStart: func(attempt int) {
+			events = append(events, fmt.Sprintf("inner.AttemptStart(%d)", attempt))
+		},
+	})
+
+	c := &http.Client{
+		Transport: NewTransport(&testTransport{status: []int{200}}),
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://example.com/", strings.NewReader("request payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("Do() = %v", err)
+	}
+	res.Body.Close()
+
+	want := []string{
+		"inner.AttemptStart(0)",
+		"outer.AttemptStart(0)",
+		"outer.AttemptDone(0, 200, <nil>)",
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %q, want %q", events, want)
+	}
+}
@@ -1,7 +1,6 @@
 package retry
 
 import (
-	"math/rand"
 	"time"
 )
 
@@ -21,6 +20,8 @@ import (
 // Special cases: the zero value is treated equally to FullJitter. Minus one
 // (-1.0) deactivates jitter.
 //
+// The random numbers are provided by the RandSource option.
+//
 // An in-depth discussion of different jitter strategies and their impact on
 // client work and server load is available at:
 // https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
@@ -44,12 +45,12 @@ func (j Jitter) apply(o *internalOptions) {
 	o.Jitter = j
 }
 
-func (j Jitter) jitter(d time.Duration) time.Duration {
+func (j Jitter) jitter(d time.Duration, rnd RandSource) time.Duration {
 	if j < 0.0 {
 		return d
 	}
 
-	r := rand.Float64() * float64(d)
+	r := rnd.float64() * float64(d)
 	if j > 0.0 && j < 1.0 {
 		r = float64(j)*r + float64(1.0-j)*float64(d)
 	}
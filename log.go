@@ -0,0 +1,145 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// Log logs the progress of calls with a "log/slog".Logger:
+//
+// • Failed attempts that are going to be retried are logged with
+// AttemptLevel.
+//
+// • Calls that fail, because all attempts failed, the retry budget refused a
+// retry, AdaptiveThrottle rejected the call, the error was permanent, or the
+// context was cancelled, are logged with FailureLevel.
+//
+// Successful calls are not logged. Records have the following attributes:
+//
+// • "attempt": the number of the failed attempt, starting at 1. Failures log
+// the number of attempts as "attempts" instead.
+//
+// • "error": the error returned by the attempt or call.
+//
+// • "delay": the delay before the next attempt.
+//
+// • "elapsed": the time since the call started.
+//
+// Transport adds "method" and "host" attributes, as well as "status" if the
+// attempt failed because of the response's status code.
+//
+// Implements the Option interface.
+type Log struct {
+	// Logger is the logger used. Defaults to slog.Default().
+	Logger *slog.Logger
+
+	// AttemptLevel is the level of failed attempts. Defaults to
+	// slog.LevelDebug.
+	AttemptLevel slog.Leveler
+
+	// FailureLevel is the level of failed calls. Defaults to
+	// slog.LevelWarn.
+	FailureLevel slog.Leveler
+}
+
+func (l Log) apply(opts *internalOptions) {
+	opts.observers = append(opts.observers, l)
+}
+
+func (l Log) logger() *slog.Logger {
+	if l.Logger == nil {
+		return slog.Default()
+	}
+	return l.Logger
+}
+
+func (l Log) attemptLevel() slog.Level {
+	if l.AttemptLevel == nil {
+		return slog.LevelDebug
+	}
+	return l.AttemptLevel.Level()
+}
+
+func (l Log) failureLevel() slog.Level {
+	if l.FailureLevel == nil {
+		return slog.LevelWarn
+	}
+	return l.FailureLevel.Level()
+}
+
+type logStartKey struct{}
+
+func (l Log) start(ctx context.Context) context.Context {
+	return context.WithValue(ctx, logStartKey{}, time.Now())
+}
+
+func (l Log) backoff(ctx context.Context, attempt int, err error, delay time.Duration) {
+	attrs := append(logAttrs(ctx, err),
+		slog.Int("attempt", attempt+1),
+		slog.Any("error", err),
+		slog.Duration("delay", delay),
+		elapsed(ctx))
+
+	l.logger().LogAttrs(ctx, l.attemptLevel(), "attempt failed", attrs...)
+}
+
+func (l Log) done(ctx context.Context, attempts int, err error) {
+	if err == nil {
+		return
+	}
+
+	msg := "giving up"
+	switch {
+	case errors.Is(err, ErrExhausted):
+		msg = "retry budget exhausted"
+	case errors.Is(err, ErrThrottled):
+		msg = "call throttled"
+	}
+
+	attrs := append(logAttrs(ctx, err),
+		slog.Int("attempts", attempts),
+		slog.Any("error", err),
+		elapsed(ctx))
+
+	l.logger().LogAttrs(ctx, l.failureLevel(), msg, attrs...)
+}
+
+func elapsed(ctx context.Context) slog.Attr {
+	start, ok := ctx.Value(logStartKey{}).(time.Time)
+	if !ok {
+		return slog.Attr{}
+	}
+	return slog.Duration("elapsed", time.Since(start))
+}
+
+type logAttrsKey struct{}
+
+// withLogAttrs returns a context holding attrs, which are added to records
+// logged by Log.
+func withLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	prev, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+
+	all := make([]slog.Attr, 0, len(prev)+len(attrs))
+	all = append(all, prev...)
+	all = append(all, attrs...)
+
+	return context.WithValue(ctx, logAttrsKey{}, all)
+}
+
+// logAttrs returns the attributes added with withLogAttrs and the "status"
+// attribute, if err was caused by an HTTP status code.
+func logAttrs(ctx context.Context, err error) []slog.Attr {
+	prev, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+
+	attrs := make([]slog.Attr, 0, len(prev)+5)
+	attrs = append(attrs, prev...)
+
+	var se statusError
+	if errors.As(err, &se) {
+		attrs = append(attrs, slog.Int("status", se.code))
+	}
+
+	return attrs
+}
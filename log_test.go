@@ -0,0 +1,171 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func ExampleLog() {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	c := &http.Client{
+		Transport: NewTransport(nil, Log{
+			Logger:       logger,
+			AttemptLevel: slog.LevelInfo,
+			FailureLevel: slog.LevelError,
+		}),
+	}
+	_ = c
+}
+
+// recordHandler is a slog.Handler recording all records.
+type recordHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *recordHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.records = append(h.records, r.Clone())
+	return nil
+}
+
+func (h *recordHandler) Records() []slog.Record {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]slog.Record(nil), h.records...)
+}
+
+func recordAttrs(r slog.Record) map[string]slog.Value {
+	attrs := make(map[string]slog.Value)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs[a.Key] = a.Value
+		return true
+	})
+	return attrs
+}
+
+func TestLog(t *testing.T) {
+	h := &recordHandler{}
+	errFailed := errors.New("temporary failure")
+
+	err := Do(context.Background(), func(context.Context) error {
+		return errFailed
+	}, Attempts(3), rpcTestBackoff, Log{Logger: slog.New(h)})
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("Do() = %v, want %v", err, errFailed)
+	}
+
+	records := h.Records()
+	if got, want := len(records), 4; got != want {
+		t.Fatalf("got %d records, want %d", got, want)
+	}
+
+	for i, r := range records[:3] {
+		if r.Level != slog.LevelDebug || r.Message != "attempt failed" {
+			t.Errorf("records[%d] = %v %q, want DEBUG \"attempt failed\"", i, r.Level, r.Message)
+		}
+
+		attrs := recordAttrs(r)
+		if got, want := attrs["attempt"].Int64(), int64(i+1); got != want {
+			t.Errorf("records[%d]: attempt = %d, want %d", i, got, want)
+		}
+		for _, key := range []string{"error", "delay", "elapsed"} {
+			if _, ok := attrs[key]; !ok {
+				t.Errorf("records[%d]: attribute %q is missing", i, key)
+			}
+		}
+	}
+
+	r := records[3]
+	if r.Level != slog.LevelWarn || r.Message != "giving up" {
+		t.Errorf("records[3] = %v %q, want WARN \"giving up\"", r.Level, r.Message)
+	}
+	attrs := recordAttrs(r)
+	if got, want := attrs["attempts"].Int64(), int64(3); got != want {
+		t.Errorf("attempts = %d, want %d", got, want)
+	}
+	if got, want := attrs["error"].String(), errFailed.Error(); got != want {
+		t.Errorf("error = %q, want %q", got, want)
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	h := &recordHandler{}
+	l := Log{
+		Logger:       slog.New(h),
+		AttemptLevel: slog.LevelInfo,
+		FailureLevel: slog.LevelError,
+	}
+
+	// Successful calls are not logged.
+	Do(context.Background(), func(context.Context) error {
+		return nil
+	}, l)
+	if got := len(h.Records()); got != 0 {
+		t.Errorf("got %d records for a successful call, want 0", got)
+	}
+
+	// TokenBudget without deposits refuses all retries.
+	err := Do(context.Background(), func(context.Context) error {
+		return errors.New("temporary failure")
+	}, rpcTestBackoff, &TokenBudget{}, l)
+	if !errors.Is(err, ErrExhausted) {
+		t.Fatalf("Do() = %v, want %v", err, ErrExhausted)
+	}
+
+	records := h.Records()
+	if got, want := len(records), 2; got != want {
+		t.Fatalf("got %d records, want %d", got, want)
+	}
+	if r := records[0]; r.Level != slog.LevelInfo || r.Message != "attempt failed" {
+		t.Errorf("records[0] = %v %q, want INFO \"attempt failed\"", r.Level, r.Message)
+	}
+	if r := records[1]; r.Level != slog.LevelError || r.Message != "retry budget exhausted" {
+		t.Errorf("records[1] = %v %q, want ERROR \"retry budget exhausted\"", r.Level, r.Message)
+	}
+}
+
+func TestLogTransport(t *testing.T) {
+	h := &recordHandler{}
+
+	c := &http.Client{
+		Transport: NewTransport(&testTransport{status: []int{503, 502}},
+			Attempts(2), rpcTestBackoff, Log{Logger: slog.New(h)}),
+	}
+
+	if _, err := c.Post("http://example.com/", "text/plain", strings.NewReader("request payload")); err == nil {
+		t.Fatal("Post() succeeded, want error")
+	}
+
+	records := h.Records()
+	if got, want := len(records), 3; got != want {
+		t.Fatalf("got %d records, want %d", got, want)
+	}
+
+	for i, wantStatus := range []int64{503, 502} {
+		attrs := recordAttrs(records[i])
+		if got, want := attrs["method"].String(), "POST"; got != want {
+			t.Errorf("records[%d]: method = %q, want %q", i, got, want)
+		}
+		if got, want := attrs["host"].String(), "example.com"; got != want {
+			t.Errorf("records[%d]: host = %q, want %q", i, got, want)
+		}
+		if got := attrs["status"].Int64(); got != wantStatus {
+			t.Errorf("records[%d]: status = %d, want %d", i, got, wantStatus)
+		}
+	}
+}
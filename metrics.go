@@ -0,0 +1,274 @@
+package retry
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics collects metrics about retried calls and retry budgets and serves
+// them in the Prometheus text exposition format. Metrics does not depend on
+// the Prometheus client library; register it with an HTTP server, for example
+// at "/metrics", and point Prometheus at it.
+//
+// Calls are recorded by passing the Option returned by Metrics.Option to Do()
+// or NewTransport(). Budgets are exported by calling Metrics.RegisterBudget.
+// Both are labeled with a user-supplied name, which is exported as the "name"
+// label.
+//
+// The following metrics are exported:
+//
+// • retry_attempts: histogram of the number of attempts per call.
+//
+// • retry_backoff_seconds: histogram of the (jittered) backoff delays.
+//
+// • retry_exhausted_total: number of calls ended by an exhausted retry budget.
+//
+// • retry_budget_initial_rate, retry_budget_retry_rate, retry_budget_ratio and
+// retry_budget_exhausted: the current state of a Budget, see BudgetStats.
+//
+// • retry_budget_refused_total: number of retries refused by a Budget.
+//
+// • retry_budget_overloads_total and retry_budget_overload_rewrites_total:
+// requests handled by BudgetHandler in overload, and responses whose status
+// code was changed as a result.
+//
+// The zero value is ready to use. Metrics must not be copied after first use.
+type Metrics struct {
+	mu      sync.Mutex
+	calls   map[string]*callMetrics
+	budgets map[string]*Budget
+}
+
+var (
+	attemptsBuckets = []float64{1, 2, 3, 4, 5, 6, 8, 10}
+	backoffBuckets  = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+// Option returns an Option that records the calls made by Do() or Transport
+// under name.
+func (m *Metrics) Option(name string) Option {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.calls == nil {
+		m.calls = make(map[string]*callMetrics)
+	}
+
+	cm, ok := m.calls[name]
+	if !ok {
+		cm = &callMetrics{
+			attempts: newHistogram(attemptsBuckets),
+			delays:   newHistogram(backoffBuckets),
+		}
+		m.calls[name] = cm
+	}
+
+	return cm
+}
+
+// RegisterBudget exports the state of b under name. Registering another
+// budget with the same name replaces b.
+func (m *Metrics) RegisterBudget(name string, b *Budget) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.budgets == nil {
+		m.budgets = make(map[string]*Budget)
+	}
+	m.budgets[name] = b
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	bw := bufio.NewWriter(w)
+	m.write(bw)
+	bw.Flush()
+}
+
+func (m *Metrics) write(w *bufio.Writer) {
+	m.mu.Lock()
+	callNames := sortedKeys(m.calls)
+	calls := make([]*callMetrics, len(callNames))
+	for i, name := range callNames {
+		calls[i] = m.calls[name]
+	}
+	budgetNames := sortedKeys(m.budgets)
+	stats := make([]BudgetStats, len(budgetNames))
+	for i, name := range budgetNames {
+		stats[i] = m.budgets[name].Stats()
+	}
+	m.mu.Unlock()
+
+	if len(calls) != 0 {
+		header(w, "retry_attempts", "histogram", "Number of attempts per call.")
+		for i, cm := range calls {
+			cm.mu.Lock()
+			cm.attempts.write(w, "retry_attempts", callNames[i])
+			cm.mu.Unlock()
+		}
+
+		header(w, "retry_backoff_seconds", "histogram", "Backoff delay between attempts.")
+		for i, cm := range calls {
+			cm.mu.Lock()
+			cm.delays.write(w, "retry_backoff_seconds", callNames[i])
+			cm.mu.Unlock()
+		}
+
+		header(w, "retry_exhausted_total", "counter", "Number of calls ended by an exhausted retry budget.")
+		for i, cm := range calls {
+			cm.mu.Lock()
+			sample(w, "retry_exhausted_total", callNames[i], "", float64(cm.exhausted))
+			cm.mu.Unlock()
+		}
+	}
+
+	if len(stats) == 0 {
+		return
+	}
+
+	gauges := []struct {
+		name, typ, help string
+		value           func(BudgetStats) float64
+	}{
+		{"retry_budget_initial_rate", "gauge", "Rate of initial calls, in calls per second.",
+			func(s BudgetStats) float64 { return s.InitialRate }},
+		{"retry_budget_retry_rate", "gauge", "Rate of retries, in calls per second.",
+			func(s BudgetStats) float64 { return s.RetryRate }},
+		{"retry_budget_ratio", "gauge", "Effective ratio of retries, to initial or total calls as configured by RatioMode.",
+			func(s BudgetStats) float64 { return s.Ratio }},
+		{"retry_budget_exhausted", "gauge", "Whether the retry budget currently refuses retries.",
+			func(s BudgetStats) float64 {
+				if s.Exhausted {
+					return 1
+				}
+				return 0
+			}},
+		{"retry_budget_refused_total", "counter", "Number of retries refused by the retry budget.",
+			func(s BudgetStats) float64 { return float64(s.Refused) }},
+		{"retry_budget_overloads_total", "counter", "Number of requests handled by BudgetHandler in overload.",
+			func(s BudgetStats) float64 { return float64(s.Overloads) }},
+		{"retry_budget_overload_rewrites_total", "counter", "Number of responses rewritten by BudgetHandler in overload.",
+			func(s BudgetStats) float64 { return float64(s.Rewrites) }},
+	}
+
+	for _, g := range gauges {
+		header(w, g.name, g.typ, g.help)
+		for i, s := range stats {
+			sample(w, g.name, budgetNames[i], "", g.value(s))
+		}
+	}
+}
+
+// callMetrics records the metrics of calls with one name. It implements the
+// Option interface.
+type callMetrics struct {
+	mu        sync.Mutex
+	attempts  *histogram
+	delays    *histogram
+	exhausted uint64
+}
+
+func (cm *callMetrics) apply(opts *internalOptions) {
+	opts.observers = append(opts.observers, cm)
+}
+
+func (cm *callMetrics) start(ctx context.Context) context.Context {
+	return ctx
+}
+
+func (cm *callMetrics) backoff(_ context.Context, _ int, _ error, delay time.Duration) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.delays.observe(delay.Seconds())
+}
+
+func (cm *callMetrics) done(_ context.Context, attempts int, err error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.attempts.observe(float64(attempts))
+	if errors.Is(err, ErrExhausted) {
+		cm.exhausted++
+	}
+}
+
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) write(w *bufio.Writer, metric, name string) {
+	for i, b := range h.bounds {
+		sample(w, metric+"_bucket", name, formatFloat(b), float64(h.counts[i]))
+	}
+	sample(w, metric+"_bucket", name, "+Inf", float64(h.count))
+	sample(w, metric+"_sum", name, "", h.sum)
+	sample(w, metric+"_count", name, "", float64(h.count))
+}
+
+func header(w *bufio.Writer, metric, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", metric, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", metric, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sample(w *bufio.Writer, metric, name, le string, v float64) {
+	fmt.Fprintf(w, "%s{name=\"%s\"", metric, labelEscaper.Replace(name))
+	if le != "" {
+		fmt.Fprintf(w, ",le=\"%s\"", le)
+	}
+	fmt.Fprintf(w, "} %s\n", formatFloat(v))
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,86 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func ExampleMetrics() {
+	// metrics is a global variable collecting all retry related metrics.
+	var metrics Metrics
+
+	// fooBudget is the retry budget of the "foo" backend.
+	var fooBudget = Budget{
+		Rate:  1.0,
+		Ratio: 0.1,
+	}
+	metrics.RegisterBudget("foo", &fooBudget)
+
+	c := &http.Client{
+		Transport: NewTransport(http.DefaultTransport, &fooBudget, metrics.Option("foo")),
+	}
+	_ = c // use c to talk to foo
+
+	// Serve all metrics at "/metrics".
+	http.Handle("/metrics", &metrics)
+}
+
+func TestMetrics(t *testing.T) {
+	var m Metrics
+
+	ctx := context.Background()
+	cb := func(_ context.Context) error {
+		return errors.New("temporary failure")
+	}
+	backoff := ExpBackoff{
+		Base:   time.Millisecond,
+		Max:    time.Millisecond,
+		Factor: 1.0,
+	}
+
+	Do(ctx, cb, Attempts(3), backoff, WithoutJitter, m.Option("foo"))
+	Do(ctx, cb, Attempts(3), backoff, WithoutJitter, m.Option("foo"), &TokenBudget{})
+
+	b := &Budget{Ratio: 0.1}
+	b.sendOK(false)
+	b.sendOK(true)
+	b.sendOK(true)
+	m.RegisterBudget(`b"a\r`, b)
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if got, want := w.Header().Get("Content-Type"), "text/plain; version=0.0.4; charset=utf-8"; got != want {
+		t.Errorf("Content-Type = %q, want %q", got, want)
+	}
+
+	body := w.Body.String()
+	t.Log(body)
+
+	wantLines := []string{
+		"# TYPE retry_attempts histogram",
+		`retry_attempts_bucket{name="foo",le="1"} 1`,
+		`retry_attempts_bucket{name="foo",le="3"} 2`,
+		`retry_attempts_bucket{name="foo",le="+Inf"} 2`,
+		`retry_attempts_sum{name="foo"} 4`,
+		`retry_attempts_count{name="foo"} 2`,
+		"# TYPE retry_backoff_seconds histogram",
+		`retry_backoff_seconds_bucket{name="foo",le="0.001"} 4`,
+		`retry_backoff_seconds_count{name="foo"} 4`,
+		"# TYPE retry_exhausted_total counter",
+		`retry_exhausted_total{name="foo"} 1`,
+		`retry_budget_refused_total{name="b\"a\\r"} 1`,
+		`retry_budget_exhausted{name="b\"a\\r"} 1`,
+		`retry_budget_overloads_total{name="b\"a\\r"} 0`,
+	}
+	for _, want := range wantLines {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics do not contain %q", want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Package retryotel implements the Tracer interface of
+// "github.com/octo/retry" with OpenTelemetry. It is a separate module, so that
+// the retry package does not depend on OpenTelemetry.
+//
+// Usage:
+//
+//	tracing := retry.Tracing{
+//		Tracer: retryotel.NewTracer(nil),
+//	}
+//	err := retry.Do(ctx, cb, tracing)
+package retryotel
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/octo/retry"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName is the name of the OpenTelemetry tracer.
+const instrumentationName = "github.com/octo/retry"
+
+// Tracer implements the retry.Tracer interface with an OpenTelemetry tracer.
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// NewTracer returns a new Tracer using tp. If tp is nil, the global tracer
+// provider is used.
+func NewTracer(tp trace.TracerProvider) *Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+
+	return &Tracer{
+		tracer: tp.Tracer(instrumentationName),
+	}
+}
+
+// Start implements the retry.Tracer interface.
+func (t *Tracer) Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, retry.Span) {
+	ctx, s := t.tracer.Start(ctx, name, trace.WithAttributes(convert(attrs)...))
+	return ctx, span{s}
+}
+
+type span struct {
+	trace.Span
+}
+
+func (s span) SetAttributes(attrs ...slog.Attr) {
+	s.Span.SetAttributes(convert(attrs)...)
+}
+
+func (s span) AddEvent(name string, attrs ...slog.Attr) {
+	s.Span.AddEvent(name, trace.WithAttributes(convert(attrs)...))
+}
+
+func (s span) End(err error) {
+	if err != nil {
+		s.Span.RecordError(err)
+		s.Span.SetStatus(codes.Error, err.Error())
+	}
+	s.Span.End()
+}
+
+// convert converts slog attributes to OpenTelemetry attributes. Durations are
+// converted to seconds, and groups are flattened using dots, e.g.
+// "group.key".
+func convert(attrs []slog.Attr) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		kvs = appendAttr(kvs, "", a)
+	}
+	return kvs
+}
+
+func appendAttr(kvs []attribute.KeyValue, prefix string, a slog.Attr) []attribute.KeyValue {
+	if a.Equal(slog.Attr{}) {
+		return kvs
+	}
+
+	key := prefix + a.Key
+	v := a.Value.Resolve()
+
+	switch v.Kind() {
+	case slog.KindString:
+		return append(kvs, attribute.String(key, v.String()))
+	case slog.KindInt64:
+		return append(kvs, attribute.Int64(key, v.Int64()))
+	case slog.KindUint64:
+		return append(kvs, attribute.Int64(key, int64(v.Uint64())))
+	case slog.KindFloat64:
+		return append(kvs, attribute.Float64(key, v.Float64()))
+	case slog.KindBool:
+		return append(kvs, attribute.Bool(key, v.Bool()))
+	case slog.KindDuration:
+		return append(kvs, attribute.Float64(key, v.Duration().Seconds()))
+	case slog.KindTime:
+		return append(kvs, attribute.String(key, v.Time().Format(time.RFC3339Nano)))
+	case slog.KindGroup:
+		if a.Key != "" {
+			prefix = key + "."
+		}
+		for _, ga := range v.Group() {
+			kvs = appendAttr(kvs, prefix, ga)
+		}
+		return kvs
+	default:
+		return append(kvs, attribute.String(key, fmt.Sprint(v.Any())))
+	}
+}
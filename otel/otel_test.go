@@ -0,0 +1,71 @@
+package retryotel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/octo/retry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracer(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+
+	var calls int
+	err := retry.Do(context.Background(), func(context.Context) error {
+		calls++
+		if calls < 2 {
+			return errors.New("temporary failure")
+		}
+		return nil
+	}, retry.ExpBackoff{Base: time.Millisecond, Max: time.Millisecond, Factor: 1},
+		retry.Tracing{Tracer: NewTracer(tp)})
+	if err != nil {
+		t.Fatalf("Do() = %v", err)
+	}
+
+	spans := sr.Ended()
+	if got, want := len(spans), 3; got != want {
+		t.Fatalf("got %d spans, want %d", got, want)
+	}
+
+	// Spans are recorded when they end: attempts first, then the call.
+	first, second, call := spans[0], spans[1], spans[2]
+
+	if got, want := call.Name(), "retry.Do"; got != want {
+		t.Errorf("call span name = %q, want %q", got, want)
+	}
+	for _, s := range []sdktrace.ReadOnlySpan{first, second} {
+		if s.Parent().SpanID() != call.SpanContext().SpanID() {
+			t.Errorf("span %q is not a child of the call's span", s.Name())
+		}
+	}
+
+	if got, want := first.Status().Code, codes.Error; got != want {
+		t.Errorf("first attempt status = %v, want %v", got, want)
+	}
+	if got, want := second.Status().Code, codes.Unset; got != want {
+		t.Errorf("second attempt status = %v, want %v", got, want)
+	}
+
+	wantAttr := attribute.Int64("attempts", 2)
+	var found bool
+	for _, kv := range call.Attributes() {
+		if kv == wantAttr {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("call attributes = %v, want %v", call.Attributes(), wantAttr)
+	}
+
+	if events := call.Events(); len(events) != 1 || events[0].Name != "backoff" {
+		t.Errorf("call events = %v, want one backoff event", events)
+	}
+}
@@ -0,0 +1,163 @@
+package retry
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// budgetFormatVersion is the version of the format written by
+// Budget.MarshalBinary.
+const budgetFormatVersion = 1
+
+// savedBucketSize is the size of an encoded bucket: a 64-bit epoch and a 64-bit
+// count.
+const savedBucketSize = 16
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface. It encodes
+// the moving windows of initial calls and retries, so that the state of the
+// budget can be saved during a graceful shutdown and restored with
+// UnmarshalBinary after a restart. The settings, such as Rate and Ratio, and
+// the counters reported by Stats are not included.
+func (b *Budget) MarshalBinary() ([]byte, error) {
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+	b.init()
+
+	data := []byte{budgetFormatVersion}
+	data = binary.BigEndian.AppendUint64(data, uint64(b.resolution()))
+	data = b.initialCalls.appendBinary(data)
+	data = b.retriedCalls.appendBinary(data)
+
+	return data, nil
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface. It
+// restores the state saved by MarshalBinary. Calls made while the process was
+// not running are not known, so the restored calls age by the wall-clock time
+// that passed since the state was saved: calls that are older than Window are
+// dropped, and the remaining calls leave the window as time passes.
+//
+// The budget must be configured before calling UnmarshalBinary, and its
+// Resolution must match the resolution of the saved budget. Calls already
+// accounted by the budget are kept.
+func (b *Budget) UnmarshalBinary(data []byte) error {
+	if err := b.Validate(); err != nil {
+		return err
+	}
+
+	if len(data) < 9 {
+		return errors.New("invalid Budget encoding: too short")
+	}
+	if version := data[0]; version != budgetFormatVersion {
+		return fmt.Errorf("invalid Budget encoding: unsupported version %d", version)
+	}
+	if res := time.Duration(binary.BigEndian.Uint64(data[1:])); res != b.resolution() {
+		return fmt.Errorf("saved Budget has resolution %v, want %v", res, b.resolution())
+	}
+	data = data[9:]
+
+	initialCalls, data, err := readWindow(data)
+	if err != nil {
+		return err
+	}
+	retriedCalls, data, err := readWindow(data)
+	if err != nil {
+		return err
+	}
+	if len(data) != 0 {
+		return fmt.Errorf("invalid Budget encoding: %d trailing bytes", len(data))
+	}
+
+	b.init()
+	b.initialCalls.restore(initialCalls)
+	b.retriedCalls.restore(retriedCalls)
+
+	return nil
+}
+
+// savedWindow is the decoded state of a movingRate.
+type savedWindow struct {
+	first, last int64
+	epochs      []int64
+	counts      []int64
+}
+
+// appendBinary appends the non-empty buckets of mr to data.
+func (mr *movingRate) appendBinary(data []byte) []byte {
+	mr.init()
+
+	var w savedWindow
+	w.first, w.last = mr.first.Load(), mr.last.Load()
+	for i := range mr.buckets {
+		b := mr.buckets[i].Load()
+		if b == nil {
+			continue
+		}
+		if n := b.count.Load(); n > 0 {
+			w.epochs = append(w.epochs, b.epoch)
+			w.counts = append(w.counts, n)
+		}
+	}
+
+	data = binary.BigEndian.AppendUint64(data, uint64(w.first))
+	data = binary.BigEndian.AppendUint64(data, uint64(w.last))
+	data = binary.BigEndian.AppendUint32(data, uint32(len(w.epochs)))
+	for i := range w.epochs {
+		data = binary.BigEndian.AppendUint64(data, uint64(w.epochs[i]))
+		data = binary.BigEndian.AppendUint64(data, uint64(w.counts[i]))
+	}
+
+	return data
+}
+
+// readWindow decodes a window written by appendBinary and returns the
+// remaining data.
+func readWindow(data []byte) (savedWindow, []byte, error) {
+	var w savedWindow
+
+	if len(data) < 20 {
+		return w, nil, errors.New("invalid Budget encoding: too short")
+	}
+	w.first = int64(binary.BigEndian.Uint64(data))
+	w.last = int64(binary.BigEndian.Uint64(data[8:]))
+	n := binary.BigEndian.Uint32(data[16:])
+	data = data[20:]
+
+	// Compare before multiplying, which could overflow int.
+	if uint64(n) > uint64(len(data)/savedBucketSize) {
+		return w, nil, errors.New("invalid Budget encoding: too short")
+	}
+	for i := 0; i < int(n); i++ {
+		bucket := data[savedBucketSize*i:]
+		w.epochs = append(w.epochs, int64(binary.BigEndian.Uint64(bucket)))
+		w.counts = append(w.counts, int64(binary.BigEndian.Uint64(bucket[8:])))
+	}
+
+	return w, data[savedBucketSize*int(n):], nil
+}
+
+// restore adds the buckets of w to mr.
+func (mr *movingRate) restore(w savedWindow) {
+	if w.first == 0 {
+		return
+	}
+	mr.init()
+
+	for {
+		first := mr.first.Load()
+		if first != 0 && first <= w.first {
+			break
+		}
+		if mr.first.CompareAndSwap(first, w.first) {
+			break
+		}
+	}
+	mr.touch(w.last)
+
+	for i, epoch := range w.epochs {
+		mr.addEpoch(epoch, int(w.counts[i]))
+	}
+}
@@ -0,0 +1,91 @@
+package retry
+
+import (
+	"encoding"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+var (
+	_ encoding.BinaryMarshaler   = (*Budget)(nil)
+	_ encoding.BinaryUnmarshaler = (*Budget)(nil)
+)
+
+func TestBudgetMarshalBinary(t *testing.T) {
+	b := &Budget{Ratio: 0.1}
+	b.init()
+
+	now := time.Now()
+	// These calls are older than the window and must be ignored after
+	// restoring the budget.
+	b.initialCalls.Add(now.Add(-90*time.Second), 1000)
+	b.retriedCalls.Add(now.Add(-90*time.Second), 1000)
+	b.initialCalls.Add(now.Add(-30*time.Second), 60)
+	b.retriedCalls.Add(now.Add(-20*time.Second), 12)
+
+	data, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() = %v", err)
+	}
+
+	restored := &Budget{Ratio: 0.1}
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary() = %v", err)
+	}
+
+	stats := restored.Stats()
+	if got, want := stats.InitialRate, 1.0; math.Abs(got-want) > 0.01 {
+		t.Errorf("InitialRate = %g, want %g", got, want)
+	}
+	if got, want := stats.RetryRate, 0.2; math.Abs(got-want) > 0.01 {
+		t.Errorf("RetryRate = %g, want %g", got, want)
+	}
+	if !stats.Exhausted {
+		t.Errorf("Exhausted = false, want true")
+	}
+
+	// restoring into a budget that has been used keeps existing calls.
+	used := &Budget{Ratio: 0.1}
+	used.sendOK(false)
+	if err := used.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary() = %v", err)
+	}
+	if got, want := used.initialCalls.countAt(now.UnixNano()), 61.0; got != want {
+		t.Errorf("initial calls = %g, want %g", got, want)
+	}
+}
+
+func TestBudgetUnmarshalBinaryErrors(t *testing.T) {
+	b := &Budget{}
+	data, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() = %v", err)
+	}
+
+	// A window claiming more buckets than the data holds.
+	huge := append([]byte(nil), data[:9+16]...)
+	huge = binary.BigEndian.AppendUint32(huge, math.MaxUint32)
+	huge = append(huge, make([]byte, 32)...)
+
+	cases := []struct {
+		name   string
+		budget *Budget
+		data   []byte
+	}{
+		{"bucket count", &Budget{}, huge},
+		{"empty", &Budget{}, nil},
+		{"truncated", &Budget{}, data[:len(data)-1]},
+		{"trailing data", &Budget{}, append(data[:len(data):len(data)], 0)},
+		{"version", &Budget{}, append([]byte{42}, data[1:]...)},
+		{"resolution", &Budget{Resolution: 2 * time.Second}, data},
+		{"invalid budget", &Budget{Rate: -1}, data},
+	}
+
+	for _, c := range cases {
+		if err := c.budget.UnmarshalBinary(c.data); err == nil {
+			t.Errorf("%s: UnmarshalBinary() = nil, want error", c.name)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package retry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy is a retry policy that can be loaded from configuration files. Its
+// JSON encoding is compatible with the "retryPolicy" object of the gRPC
+// service config, for example:
+//
+//	{
+//	  "maxAttempts": 4,
+//	  "initialBackoff": "0.1s",
+//	  "maxBackoff": "1s",
+//	  "backoffMultiplier": 2,
+//	  "retryableStatusCodes": ["UNAVAILABLE", "RESOURCE_EXHAUSTED"]
+//	}
+//
+// Durations are encoded as decimal seconds with an "s" suffix. Status codes
+// are gRPC status codes, either by name or by number.
+//
+// Unlike the gRPC service config, all fields are optional. Zero values select
+// the defaults of Do(). Unknown fields are rejected.
+//
+// Only Transport can apply RetryableStatusCodes. Use TransportOptions to
+// configure a Transport and Options for everything else, such as Do().
+type Policy struct {
+	// MaxAttempts is the maximum number of attempts, including the
+	// original call. See Attempts.
+	MaxAttempts int
+
+	// InitialBackoff, MaxBackoff and BackoffMultiplier configure the
+	// exponential backoff. See ExpBackoff.
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+
+	// RetryableStatusCodes are the names of the gRPC status codes that are
+	// retried, for example "UNAVAILABLE". They are mapped to HTTP status
+	// codes for Transport, see TransportOptions. Options does not include
+	// them, because other errors carry no status code.
+	RetryableStatusCodes []string
+
+	// PerAttemptRecvTimeout is the timeout of each attempt. See Timeout.
+	PerAttemptRecvTimeout time.Duration
+}
+
+// grpcStatusCodes maps the names of gRPC status codes to their numeric value.
+var grpcStatusCodes = map[string]int{
+	"OK":                  0,
+	"CANCELLED":           1,
+	"UNKNOWN":             2,
+	"INVALID_ARGUMENT":    3,
+	"DEADLINE_EXCEEDED":   4,
+	"NOT_FOUND":           5,
+	"ALREADY_EXISTS":      6,
+	"PERMISSION_DENIED":   7,
+	"RESOURCE_EXHAUSTED":  8,
+	"FAILED_PRECONDITION": 9,
+	"ABORTED":             10,
+	"OUT_OF_RANGE":        11,
+	"UNIMPLEMENTED":       12,
+	"INTERNAL":            13,
+	"UNAVAILABLE":         14,
+	"DATA_LOSS":           15,
+	"UNAUTHENTICATED":     16,
+}
+
+// grpcToHTTP maps gRPC status codes to the HTTP status codes used for them by
+// gRPC gateways.
+var grpcToHTTP = map[string]int{
+	"CANCELLED":           499, // Client Closed Request
+	"UNKNOWN":             http.StatusInternalServerError,
+	"INVALID_ARGUMENT":    http.StatusBadRequest,
+	"DEADLINE_EXCEEDED":   http.StatusGatewayTimeout,
+	"NOT_FOUND":           http.StatusNotFound,
+	"ALREADY_EXISTS":      http.StatusConflict,
+	"PERMISSION_DENIED":   http.StatusForbidden,
+	"RESOURCE_EXHAUSTED":  http.StatusTooManyRequests,
+	"FAILED_PRECONDITION": http.StatusBadRequest,
+	"ABORTED":             http.StatusConflict,
+	"OUT_OF_RANGE":        http.StatusBadRequest,
+	"UNIMPLEMENTED":       http.StatusNotImplemented,
+	"INTERNAL":            http.StatusInternalServerError,
+	"UNAVAILABLE":         http.StatusServiceUnavailable,
+	"DATA_LOSS":           http.StatusInternalServerError,
+	"UNAUTHENTICATED":     http.StatusUnauthorized,
+}
+
+// policyJSON is the JSON encoding of Policy.
+type policyJSON struct {
+	MaxAttempts           int               `json:"maxAttempts,omitempty"`
+	InitialBackoff        string            `json:"initialBackoff,omitempty"`
+	MaxBackoff            string            `json:"maxBackoff,omitempty"`
+	BackoffMultiplier     float64           `json:"backoffMultiplier,omitempty"`
+	RetryableStatusCodes  []json.RawMessage `json:"retryableStatusCodes,omitempty"`
+	PerAttemptRecvTimeout string            `json:"perAttemptRecvTimeout,omitempty"`
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (p Policy) MarshalJSON() ([]byte, error) {
+	pj := policyJSON{
+		MaxAttempts:           p.MaxAttempts,
+		InitialBackoff:        formatSeconds(p.InitialBackoff),
+		MaxBackoff:            formatSeconds(p.MaxBackoff),
+		BackoffMultiplier:     p.BackoffMultiplier,
+		PerAttemptRecvTimeout: formatSeconds(p.PerAttemptRecvTimeout),
+	}
+
+	for _, c := range p.RetryableStatusCodes {
+		data, err := json.Marshal(c)
+		if err != nil {
+			return nil, err
+		}
+		pj.RetryableStatusCodes = append(pj.RetryableStatusCodes, data)
+	}
+
+	return json.Marshal(pj)
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface. The decoded policy
+// is validated, see Validate.
+func (p *Policy) UnmarshalJSON(data []byte) error {
+	var pj policyJSON
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&pj); err != nil {
+		return err
+	}
+
+	var (
+		np  = Policy{MaxAttempts: pj.MaxAttempts, BackoffMultiplier: pj.BackoffMultiplier}
+		err error
+	)
+
+	if np.InitialBackoff, err = parseSeconds("initialBackoff", pj.InitialBackoff); err != nil {
+		return err
+	}
+	if np.MaxBackoff, err = parseSeconds("maxBackoff", pj.MaxBackoff); err != nil {
+		return err
+	}
+	if np.PerAttemptRecvTimeout, err = parseSeconds("perAttemptRecvTimeout", pj.PerAttemptRecvTimeout); err != nil {
+		return err
+	}
+
+	for i, raw := range pj.RetryableStatusCodes {
+		name, err := parseStatusCode(raw)
+		if err != nil {
+			return fmt.Errorf("retryableStatusCodes[%d]: %w", i, err)
+		}
+		np.RetryableStatusCodes = append(np.RetryableStatusCodes, name)
+	}
+
+	if err := np.Validate(); err != nil {
+		return err
+	}
+
+	*p = np
+	return nil
+}
+
+// formatSeconds formats d as decimal seconds with an "s" suffix, as used by
+// the JSON encoding of protocol buffers. Zero durations are formatted as the
+// empty string.
+func formatSeconds(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+}
+
+// parseSeconds parses a duration formatted by formatSeconds. field is used in
+// error messages.
+func parseSeconds(field, s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	f, err := strconv.ParseFloat(strings.TrimSuffix(s, "s"), 64)
+	if err != nil || !strings.HasSuffix(s, "s") || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("%s: invalid duration %q, want seconds with an \"s\" suffix, e.g. \"0.1s\"", field, s)
+	}
+
+	return time.Duration(f * float64(time.Second)), nil
+}
+
+// parseStatusCode parses a gRPC status code given by name or number and
+// returns its name.
+func parseStatusCode(raw json.RawMessage) (string, error) {
+	var name string
+	if err := json.Unmarshal(raw, &name); err == nil {
+		name = strings.ToUpper(name)
+		if _, ok := grpcStatusCodes[name]; !ok {
+			return "", fmt.Errorf("unknown status code %q", name)
+		}
+		return name, nil
+	}
+
+	var code int
+	if err := json.Unmarshal(raw, &code); err != nil {
+		return "", fmt.Errorf("invalid status code %s", raw)
+	}
+	for name, c := range grpcStatusCodes {
+		if c == code {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("unknown status code %d", code)
+}
+
+// Validate checks that the policy is valid. Errors name the JSON field of the
+// invalid setting.
+func (p Policy) Validate() error {
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("maxAttempts: got %d, must not be negative", p.MaxAttempts)
+	}
+	if p.InitialBackoff < 0 {
+		return fmt.Errorf("initialBackoff: got %v, must not be negative", p.InitialBackoff)
+	}
+	if p.MaxBackoff < 0 {
+		return fmt.Errorf("maxBackoff: got %v, must not be negative", p.MaxBackoff)
+	}
+	if p.InitialBackoff != 0 && p.MaxBackoff != 0 && p.MaxBackoff < p.InitialBackoff {
+		return fmt.Errorf("maxBackoff: got %v, must not be less than initialBackoff (%v)", p.MaxBackoff, p.InitialBackoff)
+	}
+	if p.BackoffMultiplier < 0 || math.IsNaN(p.BackoffMultiplier) || math.IsInf(p.BackoffMultiplier, 0) {
+		return fmt.Errorf("backoffMultiplier: got %v, must be a positive number", p.BackoffMultiplier)
+	}
+	if p.PerAttemptRecvTimeout < 0 {
+		return fmt.Errorf("perAttemptRecvTimeout: got %v, must not be negative", p.PerAttemptRecvTimeout)
+	}
+
+	for i, name := range p.RetryableStatusCodes {
+		if _, ok := grpcToHTTP[name]; !ok {
+			if name == "OK" {
+				return fmt.Errorf("retryableStatusCodes[%d]: %q cannot be retried", i, name)
+			}
+			return fmt.Errorf("retryableStatusCodes[%d]: unknown status code %q", i, name)
+		}
+	}
+
+	return nil
+}
+
+// Options returns the options implementing the policy, except for
+// RetryableStatusCodes, which only Transport applies; see TransportOptions.
+// Settings with a zero value are omitted, so that the defaults of Do() apply.
+func (p Policy) Options() ([]Option, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	var opts []Option
+
+	if p.MaxAttempts != 0 {
+		opts = append(opts, Attempts(p.MaxAttempts))
+	}
+
+	if p.InitialBackoff != 0 || p.MaxBackoff != 0 || p.BackoffMultiplier != 0 {
+		b := newOptions(nil).backoff.(ExpBackoff)
+		if p.InitialBackoff != 0 {
+			b.Base = p.InitialBackoff
+		}
+		if p.MaxBackoff != 0 {
+			b.Max = p.MaxBackoff
+		}
+		if b.Max < b.Base {
+			b.Max = b.Base
+		}
+		if p.BackoffMultiplier != 0 {
+			b.Factor = p.BackoffMultiplier
+		}
+		opts = append(opts, b)
+	}
+
+	if p.PerAttemptRecvTimeout != 0 {
+		opts = append(opts, Timeout(p.PerAttemptRecvTimeout))
+	}
+
+	return opts, nil
+}
+
+// TransportOptions returns the options implementing the policy for
+// NewTransport(). In addition to the options returned by Options, the
+// RetryableStatusCodes are mapped to HTTP status codes, see the
+// RetryableStatusCodes option.
+func (p Policy) TransportOptions() ([]Option, error) {
+	opts, err := p.Options()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.RetryableStatusCodes) != 0 {
+		opts = append(opts, p.httpStatusCodes())
+	}
+
+	return opts, nil
+}
+
+// httpStatusCodes maps RetryableStatusCodes to a sorted list of HTTP status
+// codes.
+func (p Policy) httpStatusCodes() RetryableStatusCodes {
+	seen := make(map[int]bool)
+	var codes RetryableStatusCodes
+
+	for _, name := range p.RetryableStatusCodes {
+		c := grpcToHTTP[name]
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		codes = append(codes, c)
+	}
+	sort.Ints(codes)
+
+	return codes
+}
@@ -0,0 +1,204 @@
+package retry
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func ExamplePolicy() {
+	// The "retryPolicy" of a gRPC service config.
+	config := `{
+		"maxAttempts": 4,
+		"initialBackoff": "0.1s",
+		"maxBackoff": "1s",
+		"backoffMultiplier": 2,
+		"retryableStatusCodes": ["UNAVAILABLE"]
+	}`
+
+	var p Policy
+	if err := json.Unmarshal([]byte(config), &p); err != nil {
+		panic(err)
+	}
+
+	opts, err := p.TransportOptions()
+	if err != nil {
+		panic(err)
+	}
+
+	c := &http.Client{
+		Transport: NewTransport(nil, opts...),
+	}
+	_ = c
+}
+
+func TestPolicyJSON(t *testing.T) {
+	config := `{
+		"maxAttempts": 5,
+		"initialBackoff": "0.1s",
+		"maxBackoff": "1.5s",
+		"backoffMultiplier": 1.5,
+		"retryableStatusCodes": ["UNAVAILABLE", "resource_exhausted", 4],
+		"perAttemptRecvTimeout": "2s"
+	}`
+
+	var got Policy
+	if err := json.Unmarshal([]byte(config), &got); err != nil {
+		t.Fatalf("json.Unmarshal() = %v", err)
+	}
+
+	want := Policy{
+		MaxAttempts:           5,
+		InitialBackoff:        100 * time.Millisecond,
+		MaxBackoff:            1500 * time.Millisecond,
+		BackoffMultiplier:     1.5,
+		RetryableStatusCodes:  []string{"UNAVAILABLE", "RESOURCE_EXHAUSTED", "DEADLINE_EXCEEDED"},
+		PerAttemptRecvTimeout: 2 * time.Second,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("json.Unmarshal() = %+v, want %+v", got, want)
+	}
+
+	data, err := json.Marshal(got)
+	if err != nil {
+		t.Fatalf("json.Marshal() = %v", err)
+	}
+	wantJSON := `{"maxAttempts":5,"initialBackoff":"0.1s","maxBackoff":"1.5s","backoffMultiplier":1.5,"retryableStatusCodes":["UNAVAILABLE","RESOURCE_EXHAUSTED","DEADLINE_EXCEEDED"],"perAttemptRecvTimeout":"2s"}`
+	if string(data) != wantJSON {
+		t.Errorf("json.Marshal() = %s, want %s", data, wantJSON)
+	}
+
+	var roundTrip Policy
+	if err := json.Unmarshal(data, &roundTrip); err != nil {
+		t.Fatalf("json.Unmarshal() = %v", err)
+	}
+	if !reflect.DeepEqual(roundTrip, want) {
+		t.Errorf("json.Unmarshal(json.Marshal()) = %+v, want %+v", roundTrip, want)
+	}
+}
+
+func TestPolicyErrors(t *testing.T) {
+	cases := []struct {
+		config    string
+		wantField string
+	}{
+		{`{"maxAttempts": -1}`, "maxAttempts"},
+		{`{"maxAttempts": "three"}`, "maxAttempts"},
+		{`{"initialBackoff": "100ms"}`, "initialBackoff"},
+		{`{"initialBackoff": "-1s"}`, "initialBackoff"},
+		{`{"maxBackoff": "fast"}`, "maxBackoff"},
+		{`{"initialBackoff": "2s", "maxBackoff": "1s"}`, "maxBackoff"},
+		{`{"backoffMultiplier": -2}`, "backoffMultiplier"},
+		{`{"perAttemptRecvTimeout": "1"}`, "perAttemptRecvTimeout"},
+		{`{"retryableStatusCodes": ["UNAVAILABLE", "BROKEN"]}`, "retryableStatusCodes[1]"},
+		{`{"retryableStatusCodes": [42]}`, "retryableStatusCodes[0]"},
+		{`{"retryableStatusCodes": ["OK"]}`, "retryableStatusCodes[0]"},
+		{`{"maxAttempt": 3}`, "maxAttempt"},
+	}
+
+	for _, tc := range cases {
+		var p Policy
+		err := json.Unmarshal([]byte(tc.config), &p)
+		if err == nil {
+			t.Errorf("json.Unmarshal(%s) succeeded, want error", tc.config)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.wantField) {
+			t.Errorf("json.Unmarshal(%s) = %q, want error mentioning %q", tc.config, err, tc.wantField)
+		}
+	}
+}
+
+func TestPolicyOptions(t *testing.T) {
+	cases := []struct {
+		policy Policy
+		want   []Option
+	}{
+		{Policy{}, nil},
+		{
+			Policy{
+				MaxAttempts:           3,
+				InitialBackoff:        time.Second,
+				PerAttemptRecvTimeout: 5 * time.Second,
+				RetryableStatusCodes:  []string{"UNAVAILABLE", "INTERNAL", "UNKNOWN"},
+			},
+			[]Option{
+				Attempts(3),
+				ExpBackoff{Base: time.Second, Max: 2 * time.Second, Factor: 2.0},
+				Timeout(5 * time.Second),
+			},
+		},
+		{
+			Policy{InitialBackoff: 5 * time.Second},
+			[]Option{ExpBackoff{Base: 5 * time.Second, Max: 5 * time.Second, Factor: 2.0}},
+		},
+	}
+
+	for _, tc := range cases {
+		got, err := tc.policy.Options()
+		if err != nil {
+			t.Errorf("%+v.Options() = %v", tc.policy, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%+v.Options() = %#v, want %#v", tc.policy, got, tc.want)
+		}
+	}
+
+	if _, err := (Policy{MaxAttempts: -1}).Options(); err == nil {
+		t.Error("Options() succeeded for an invalid policy, want error")
+	}
+
+	// Only TransportOptions includes the status codes.
+	p := Policy{
+		MaxAttempts:          3,
+		RetryableStatusCodes: []string{"UNAVAILABLE", "INTERNAL", "UNKNOWN"},
+	}
+	got, err := p.TransportOptions()
+	if err != nil {
+		t.Fatalf("TransportOptions() = %v", err)
+	}
+	if want := []Option{Attempts(3), RetryableStatusCodes{500, 503}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("TransportOptions() = %#v, want %#v", got, want)
+	}
+	if _, err := (Policy{MaxAttempts: -1}).TransportOptions(); err == nil {
+		t.Error("TransportOptions() succeeded for an invalid policy, want error")
+	}
+}
+
+func TestRetryableStatusCodes(t *testing.T) {
+	p := Policy{RetryableStatusCodes: []string{"NOT_FOUND"}}
+	opts, err := p.TransportOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append(opts, rpcTestBackoff)
+
+	cases := []struct {
+		status     []int
+		wantStatus int
+	}{
+		// 404 is retried.
+		{[]int{404, 200}, 200},
+		// 503 is not retried.
+		{[]int{503, 200}, 503},
+	}
+
+	for _, tc := range cases {
+		c := &http.Client{
+			Transport: NewTransport(&testTransport{status: tc.status}, opts...),
+		}
+
+		res, err := c.Post("http://example.com/", "text/plain", strings.NewReader("request payload"))
+		if err != nil {
+			t.Errorf("Post() = %v", err)
+			continue
+		}
+		if res.StatusCode != tc.wantStatus {
+			t.Errorf("Post().StatusCode = %d, want %d", res.StatusCode, tc.wantStatus)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package retry
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// RandSource is a source of uniformly distributed random numbers in [0,1),
+// such as (*rand.Rand).Float64. It is used to randomize backoff delays, see
+// Jitter. Setting a RandSource with a fixed seed makes the sequence of delays
+// reproducible, for example in tests and simulations.
+//
+// RandSource can be set per call, per Transport and per Budget, see Budget.Rand.
+// Do() and Transport call the RandSource sequentially for each call, but a
+// RandSource passed to NewTransport(), set in a Budget or shared between Do()
+// calls is used concurrently. Use NewRandSource() to create a seeded RandSource
+// that is safe for concurrent use. AdaptiveThrottle has its own Rand field.
+//
+// By default, random numbers are drawn from a pool of generators, so that
+// concurrent calls, typically from different goroutines, use different
+// generators and do not contend on a lock. Unlike the top-level functions of
+// "math/rand", this holds even if rand.Seed() has been called.
+//
+// Implements the Option interface.
+type RandSource func() float64
+
+func (opt RandSource) apply(opts *internalOptions) {
+	opts.rand = opt
+}
+
+// randPool holds the generators used by the nil RandSource. sync.Pool keeps a
+// cache per processor, so concurrent goroutines rarely share a generator.
+var randPool = sync.Pool{
+	New: func() any {
+		return rand.New(rand.NewSource(rand.Int63()))
+	},
+}
+
+// float64 returns a random number in [0,1). The nil RandSource uses a
+// generator from randPool.
+func (opt RandSource) float64() float64 {
+	if opt == nil {
+		r := randPool.Get().(*rand.Rand)
+		f := r.Float64()
+		randPool.Put(r)
+		return f
+	}
+	return opt()
+}
+
+// NewRandSource returns a RandSource seeded with seed. Sources created with
+// the same seed return the same sequence of numbers. The returned RandSource
+// is safe for concurrent use.
+func NewRandSource(seed int64) RandSource {
+	var (
+		mu sync.Mutex
+		r  = rand.New(rand.NewSource(seed))
+	)
+
+	return func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return r.Float64()
+	}
+}
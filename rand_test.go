@@ -0,0 +1,211 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func ExampleRandSource() {
+	// Reproducible backoff delays, e.g. for a simulation.
+	_ = Do(context.Background(), func(context.Context) error {
+		return nil
+	}, NewRandSource(42))
+}
+
+// delayRecorder is an Option recording the backoff delays of Do().
+type delayRecorder struct {
+	mu     sync.Mutex
+	delays []time.Duration
+}
+
+func (r *delayRecorder) apply(opts *internalOptions) {
+	opts.observers = append(opts.observers, r)
+}
+
+func (r *delayRecorder) start(ctx context.Context) context.Context {
+	return ctx
+}
+
+func (r *delayRecorder) backoff(_ context.Context, _ int, _ error, delay time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.delays = append(r.delays, delay)
+}
+
+func (r *delayRecorder) done(context.Context, int, error) {}
+
+func TestRandSource(t *testing.T) {
+	run := func(rnd RandSource) []time.Duration {
+		var rec delayRecorder
+		Do(context.Background(), func(context.Context) error {
+			return errors.New("temporary failure")
+		}, Attempts(6), ExpBackoff{Base: time.Microsecond, Max: time.Millisecond, Factor: 2}, EqualJitter, rnd, &rec)
+
+		return rec.delays
+	}
+
+	first := run(NewRandSource(42))
+	if got, want := len(first), 6; got != want {
+		t.Fatalf("got %d delays, want %d", got, want)
+	}
+	if second := run(NewRandSource(42)); !reflect.DeepEqual(first, second) {
+		t.Errorf("delays differ with the same seed:\n%v\n%v", first, second)
+	}
+	if other := run(NewRandSource(23)); reflect.DeepEqual(first, other) {
+		t.Errorf("delays are identical with different seeds: %v", first)
+	}
+
+	// A constant RandSource selects the upper end of the EqualJitter range.
+	want := []time.Duration{1 * time.Microsecond, 2 * time.Microsecond, 4 * time.Microsecond, 8 * time.Microsecond, 16 * time.Microsecond, 32 * time.Microsecond}
+	if got := run(func() float64 { return 1.0 }); !reflect.DeepEqual(got, want) {
+		t.Errorf("delays = %v, want %v", got, want)
+	}
+}
+
+func TestAdaptiveThrottleRand(t *testing.T) {
+	at := &AdaptiveThrottle{
+		Rand: func() float64 { return 0.0 },
+	}
+
+	// The first call fails, so the rejection probability becomes
+	// positive. With a RandSource always returning 0.0, every subsequent
+	// call is rejected.
+	if !at.sendOK() {
+		t.Fatal("first call rejected, want accepted")
+	}
+	at.done(errors.New("temporary failure"))
+
+	for i := 0; i < 3; i++ {
+		if at.sendOK() {
+			t.Errorf("call %d accepted, want rejected", i+1)
+		}
+	}
+
+	// With a RandSource always returning values close to 1.0, calls are
+	// accepted.
+	at.Rand = func() float64 { return 0.999 }
+	if !at.sendOK() {
+		t.Error("call rejected, want accepted")
+	}
+}
+
+func TestBudgetRand(t *testing.T) {
+	run := func(opts ...Option) []time.Duration {
+		var rec delayRecorder
+		opts = append(opts, Attempts(3), ExpBackoff{Base: time.Microsecond, Max: time.Millisecond, Factor: 2}, EqualJitter, &rec)
+		Do(context.Background(), func(context.Context) error {
+			return errors.New("temporary failure")
+		}, opts...)
+
+		return rec.delays
+	}
+
+	// A constant RandSource selects the upper end of the EqualJitter range.
+	budget := &Budget{Rate: 1000, Ratio: 100, Rand: func() float64 { return 1.0 }}
+	want := []time.Duration{1 * time.Microsecond, 2 * time.Microsecond, 4 * time.Microsecond}
+	if got := run(budget); !reflect.DeepEqual(got, want) {
+		t.Errorf("delays = %v, want %v", got, want)
+	}
+
+	// The RandSource of the call takes precedence, regardless of the order
+	// of options.
+	want = []time.Duration{time.Microsecond / 2, 1 * time.Microsecond, 2 * time.Microsecond}
+	zero := RandSource(func() float64 { return 0.0 })
+	if got := run(zero, budget); !reflect.DeepEqual(got, want) {
+		t.Errorf("delays = %v, want %v", got, want)
+	}
+	if got := run(budget, zero); !reflect.DeepEqual(got, want) {
+		t.Errorf("delays = %v, want %v", got, want)
+	}
+}
+
+func TestNewRandSourceConcurrent(t *testing.T) {
+	const n = 800
+
+	want := make(map[float64]bool)
+	r := rand.New(rand.NewSource(42))
+	for i := 0; i < n; i++ {
+		want[r.Float64()] = true
+	}
+
+	// Concurrent callers draw the sequence of the seed, each number once.
+	rnd := NewRandSource(42)
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		got = make(map[float64]bool)
+	)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < n/8; i++ {
+				f := rnd()
+
+				mu.Lock()
+				got[f] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d numbers, want the first %d numbers of the seed", len(got), n)
+	}
+}
+
+func TestRandSourceDefault(t *testing.T) {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		seen = make(map[float64]bool)
+	)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 100; i++ {
+				f := RandSource(nil).float64()
+				if f < 0 || f >= 1 {
+					t.Errorf("float64() = %g, want a number in [0,1)", f)
+				}
+
+				mu.Lock()
+				seen[f] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, want := len(seen), 800; got != want {
+		t.Errorf("got %d distinct numbers, want %d", got, want)
+	}
+}
+
+func BenchmarkRandSource(b *testing.B) {
+	b.Run("default", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				RandSource(nil).float64()
+			}
+		})
+	})
+	b.Run("seeded", func(b *testing.B) {
+		rnd := NewRandSource(42)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				rnd.float64()
+			}
+		})
+	})
+}
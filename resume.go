@@ -0,0 +1,271 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Resumable enables resuming response bodies after read errors. Transport
+// only retries until the response headers have been received. With
+// Resumable, reading the body of the response is resumed as well: when
+// reading Response.Body fails, for example because the connection was reset
+// halfway through a large download, the request is re-sent with a "Range:
+// bytes=N-" header and the body continues with the remaining bytes. Resumed
+// requests use the same options, such as backoff and Budget, as the original
+// request.
+//
+// To make sure that the resource has not changed, the response must have a
+// strong "ETag" or a "Last-Modified" header, which is sent back in the
+// "If-Range" header. If the server does not respond with the requested range,
+// reading fails with ErrNotResumable.
+//
+// Only bodies of successful GET requests are resumed. Responses that have
+// been decompressed transparently by "net/http".Transport, i.e. when
+// Response.Uncompressed is true, are not resumable either. Other response
+// bodies are returned unchanged.
+//
+// Resumable(true) requires a Transport; Do() returns ErrTransportOnly.
+//
+// Implements the Option interface.
+type Resumable bool
+
+func (opt Resumable) apply(opts *internalOptions) {
+	opts.resumable = bool(opt)
+}
+
+// ErrNotResumable is returned when reading a resumable response body fails and
+// the server cannot continue the response, for example because the resource
+// has changed in the meantime.
+var ErrNotResumable = errors.New("response body is not resumable")
+
+// resumableBody is a response body that re-sends its request with a "Range"
+// header when reading fails.
+type resumableBody struct {
+	rt   http.RoundTripper
+	req  *http.Request
+	opts internalOptions
+
+	// ifRange is the value of the "If-Range" header: a strong ETag or the
+	// time of the last modification.
+	ifRange string
+	etag    string
+
+	// ctx is the context of the original request. It is cancelled by
+	// Close, which aborts a resume in progress.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// readMu serializes calls to Read. It is held during I/O and backoff,
+	// so Close does not take it.
+	readMu sync.Mutex
+	offset int64
+	// stalls is the number of consecutive resumes not making progress.
+	stalls int
+	// err is returned by all reads after resuming failed.
+	err error
+
+	// mu protects body, so that Close can close the current body while
+	// Read is blocked.
+	mu     sync.Mutex
+	body   io.ReadCloser
+	closed atomic.Bool
+}
+
+var errBodyClosed = errors.New("read on closed response body")
+
+// newResumableBody returns a resumable body of res. If res is not resumable,
+// it returns res.Body.
+func newResumableBody(rt http.RoundTripper, req *http.Request, res *http.Response, opts internalOptions) io.ReadCloser {
+	if req.Method != http.MethodGet || res.StatusCode != http.StatusOK || res.Uncompressed ||
+		res.Header.Get("Accept-Ranges") == "none" {
+		return res.Body
+	}
+
+	b := &resumableBody{
+		rt:   rt,
+		req:  req,
+		opts: opts,
+		body: res.Body,
+	}
+	b.ctx, b.cancel = context.WithCancel(req.Context())
+
+	// The resumed body outlives the attempt, so the per-attempt timeout
+	// cannot apply.
+	b.opts.timeout = nil
+	b.opts.resumed = true
+
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		b.ifRange = etag
+		b.etag = etag
+	} else if lm := res.Header.Get("Last-Modified"); lm != "" {
+		b.ifRange = lm
+	} else {
+		return res.Body
+	}
+
+	return b
+}
+
+func (b *resumableBody) Read(p []byte) (int, error) {
+	b.readMu.Lock()
+	defer b.readMu.Unlock()
+
+	for {
+		if b.closed.Load() {
+			return 0, errBodyClosed
+		}
+		if b.err != nil {
+			return 0, b.err
+		}
+
+		b.mu.Lock()
+		body := b.body
+		b.mu.Unlock()
+
+		n, err := body.Read(p)
+		b.offset += int64(n)
+		if n > 0 {
+			b.stalls = 0
+		}
+
+		if b.closed.Load() {
+			return n, errBodyClosed
+		}
+		if err == nil || err == io.EOF || b.req.Context().Err() != nil {
+			return n, err
+		}
+
+		if b.opts.Attempts != 0 && b.stalls >= int(b.opts.Attempts) {
+			return n, err
+		}
+		b.stalls++
+
+		if rerr := b.resume(); rerr != nil {
+			if b.closed.Load() {
+				return n, errBodyClosed
+			}
+			b.err = fmt.Errorf("resuming response body after %v: %w", err, rerr)
+			return n, b.err
+		}
+
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume re-sends the request, asking for the remaining bytes of the body. The
+// requests are retries of the original request and are accounted as such.
+func (b *resumableBody) resume() error {
+	b.mu.Lock()
+	b.body.Close()
+	b.body = http.NoBody
+	b.mu.Unlock()
+
+	var (
+		mu   sync.Mutex
+		body io.ReadCloser
+		done bool
+	)
+
+	ctx := b.ctx
+	logCtx := withLogAttrs(ctx,
+		slog.String("method", b.req.Method),
+		slog.String("host", b.req.URL.Host))
+
+	err := do(logCtx, func(attemptCtx context.Context) error {
+		// The body outlives the attempt, so the request must use the
+		// context of the original request.
+		req := b.req.Clone(ctx)
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(b.offset, 10)+"-")
+		req.Header.Set("If-Range", b.ifRange)
+		req.Header.Set("Retry-Attempt", strconv.Itoa(Attempt(attemptCtx)+1))
+
+		res, err := b.rt.RoundTrip(req)
+		if err := checkResponse(res, err, b.opts.retryableStatusCodes); err != nil {
+			if res != nil {
+				res.Body.Close()
+			}
+			return err
+		}
+
+		if err := b.checkRange(res); err != nil {
+			res.Body.Close()
+			return Abort(err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		// do() does not wait for attempts when ctx is cancelled.
+		if done {
+			res.Body.Close()
+			return ctx.Err()
+		}
+		body = res.Body
+
+		return nil
+	}, b.opts)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	done = true
+	if err != nil {
+		if body != nil {
+			body.Close()
+		}
+		return err
+	}
+
+	// Close closes b.body after setting closed, so either it closes the
+	// new body or the new body is closed here.
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed.Load() {
+		body.Close()
+		return errBodyClosed
+	}
+	b.body = body
+	return nil
+}
+
+// checkRange checks that res continues the body at the current offset.
+func (b *resumableBody) checkRange(res *http.Response) error {
+	if res.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("%w: got status %q, want %d", ErrNotResumable, res.Status, http.StatusPartialContent)
+	}
+
+	if b.etag != "" && res.Header.Get("ETag") != b.etag {
+		return fmt.Errorf("%w: ETag changed from %s to %s", ErrNotResumable, b.etag, res.Header.Get("ETag"))
+	}
+
+	var first int64
+	cr := res.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(cr, "bytes %d-", &first); err != nil || first != b.offset {
+		return fmt.Errorf("%w: got Content-Range %q, want offset %d", ErrNotResumable, cr, b.offset)
+	}
+
+	return nil
+}
+
+// Close closes the body. It does not wait for a concurrent Read: a blocked
+// Read and a resume in progress are aborted.
+func (b *resumableBody) Close() error {
+	b.closed.Store(true)
+	b.cancel()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.body.Close()
+}
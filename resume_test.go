@@ -0,0 +1,270 @@
+package retry
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func ExampleResumable() {
+	c := &http.Client{
+		Transport: NewTransport(nil, Resumable(true)),
+	}
+
+	res, err := c.Get("http://example.com/large-file.tar.gz")
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	// Connection errors while reading the body are handled transparently.
+	_, _ = io.Copy(io.Discard, res.Body)
+}
+
+// truncatingWriter closes the connection after limit bytes of the body have
+// been written.
+type truncatingWriter struct {
+	http.ResponseWriter
+	limit int
+}
+
+func (w *truncatingWriter) Write(p []byte) (int, error) {
+	if len(p) <= w.limit {
+		w.limit -= len(p)
+		return w.ResponseWriter.Write(p)
+	}
+
+	n, _ := w.ResponseWriter.Write(p[:w.limit])
+	w.limit = 0
+	w.ResponseWriter.(http.Flusher).Flush()
+
+	conn, _, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return n, err
+	}
+	conn.Close()
+
+	return n, errors.New("connection closed")
+}
+
+// resumeTestServer serves data and cuts the first cuts responses short.
+type resumeTestServer struct {
+	data []byte
+
+	mu     sync.Mutex
+	etag   string
+	cuts   int
+	ranges []string
+}
+
+func (s *resumeTestServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	etag := s.etag
+	cut := s.cuts > 0
+	if cut {
+		s.cuts--
+	}
+	s.ranges = append(s.ranges, req.Header.Get("Range"))
+	s.mu.Unlock()
+
+	if cut {
+		w = &truncatingWriter{ResponseWriter: w, limit: 1000}
+	}
+
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(s.data))
+}
+
+func (s *resumeTestServer) Ranges() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.ranges...)
+}
+
+// recordingLimiter is a budget recording whether calls are retries.
+type recordingLimiter struct {
+	mu      sync.Mutex
+	retries []bool
+}
+
+func (l *recordingLimiter) apply(opts *internalOptions) {
+	opts.budget = l
+}
+
+func (l *recordingLimiter) sendOK(isRetry bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.retries = append(l.retries, isRetry)
+	return true
+}
+
+func TestResumable(t *testing.T) {
+	s := &resumeTestServer{
+		data: bytes.Repeat([]byte("0123456789"), 10000),
+		etag: `"v1"`,
+		cuts: 2,
+	}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	var budget recordingLimiter
+	c := &http.Client{
+		Transport: NewTransport(nil, rpcTestBackoff, Resumable(true), &budget),
+	}
+
+	res, err := c.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	defer res.Body.Close()
+
+	got, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ReadAll() = %v", err)
+	}
+	if !bytes.Equal(got, s.data) {
+		t.Errorf("got %d bytes, want %d bytes", len(got), len(s.data))
+	}
+
+	ranges := s.Ranges()
+	want := []string{"", "bytes=1000-", "bytes=2000-"}
+	if len(ranges) != len(want) {
+		t.Fatalf("Range headers = %q, want %q", ranges, want)
+	}
+	for i := range want {
+		if ranges[i] != want[i] {
+			t.Errorf("Range headers = %q, want %q", ranges, want)
+			break
+		}
+	}
+
+	// Resumed requests are retries of the original request.
+	if got, want := budget.retries, []bool{false, true, true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("budget calls (isRetry) = %v, want %v", got, want)
+	}
+}
+
+func TestResumableChanged(t *testing.T) {
+	s := &resumeTestServer{
+		data: bytes.Repeat([]byte("0123456789"), 10000),
+		etag: `"v1"`,
+		cuts: 1,
+	}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	c := &http.Client{
+		Transport: NewTransport(nil, rpcTestBackoff, Resumable(true)),
+	}
+
+	res, err := c.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	defer res.Body.Close()
+
+	// The resource changes while the body is being read.
+	s.mu.Lock()
+	s.etag = `"v2"`
+	s.mu.Unlock()
+
+	if _, err := io.ReadAll(res.Body); !errors.Is(err, ErrNotResumable) {
+		t.Errorf("ReadAll() = %v, want %v", err, ErrNotResumable)
+	}
+	// Subsequent reads keep failing.
+	if _, err := res.Body.Read(make([]byte, 1)); !errors.Is(err, ErrNotResumable) {
+		t.Errorf("Read() = %v, want %v", err, ErrNotResumable)
+	}
+}
+
+func TestResumableDisabled(t *testing.T) {
+	s := &resumeTestServer{
+		data: bytes.Repeat([]byte("0123456789"), 10000),
+		etag: `"v1"`,
+		cuts: 1,
+	}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	// Without the Resumable option, the error is returned to the caller.
+	c := &http.Client{
+		Transport: NewTransport(nil, rpcTestBackoff),
+	}
+
+	res, err := c.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	defer res.Body.Close()
+
+	if _, err := io.ReadAll(res.Body); err == nil {
+		t.Error("ReadAll() succeeded, want error")
+	}
+	if got, want := len(s.Ranges()), 1; got != want {
+		t.Errorf("got %d requests, want %d", got, want)
+	}
+}
+
+func TestResumableCloseDuringRead(t *testing.T) {
+	stall := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", "2000")
+		w.Write(make([]byte, 1000))
+		w.(http.Flusher).Flush()
+
+		// Stall mid-body until the test ends.
+		<-stall
+	}))
+	defer srv.Close()
+	defer close(stall)
+
+	c := &http.Client{
+		Transport: NewTransport(nil, rpcTestBackoff, Resumable(true)),
+	}
+
+	res, err := c.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	if _, err := io.ReadFull(res.Body, make([]byte, 1000)); err != nil {
+		t.Fatalf("ReadFull() = %v", err)
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := res.Body.Read(make([]byte, 1000))
+		readErr <- err
+	}()
+
+	// Let Read block on the stalled connection.
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- res.Body.Close()
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close() blocked by a concurrent Read")
+	}
+
+	select {
+	case err := <-readErr:
+		if err == nil {
+			t.Error("Read() = nil, want error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read() still blocked after Close()")
+	}
+}
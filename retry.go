@@ -4,7 +4,9 @@ package retry
 import (
 	"context"
 	"errors"
+	"fmt"
 	"math"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,27 +14,86 @@ type backoff interface {
 	delay(attempt int) time.Duration
 }
 
+// limiter is a retry budget, such as Budget or TokenBudget.
+type limiter interface {
+	sendOK(isRetry bool) bool
+}
+
+// attemptObserver is an observer that is notified about each attempt.
+type attemptObserver interface {
+	// attempt is called before the callback is called. The returned
+	// context is passed to the callback, and end is called with the
+	// result of the callback.
+	attempt(ctx context.Context, attempt int) (_ context.Context, end func(error))
+}
+
+// observer is notified about the progress of a do() call.
+type observer interface {
+	// start is called when do() starts. The returned context is passed to
+	// the other methods and to the callback.
+	start(ctx context.Context) context.Context
+	// backoff is called before pausing execution after attempt failed
+	// with err.
+	backoff(ctx context.Context, attempt int, err error, delay time.Duration)
+	// done is called before do() returns.
+	done(ctx context.Context, attempts int, err error)
+}
+
 type internalOptions struct {
 	Attempts
 	backoff
-	budget *Budget
+	budget      limiter
+	budgetGroup *BudgetGroup
+	throttle    *AdaptiveThrottle
+	observers   []observer
+	resumable   bool
+	// resumed is set for the requests resuming a response body. They are
+	// retries of the original request, starting with the first attempt.
+	resumed              bool
+	retryableStatusCodes RetryableStatusCodes
+	rand                 RandSource
+	// budgetRand is the Rand field of Budget, used if rand is nil.
+	budgetRand     RandSource
+	minAttemptTime time.Duration
+	timeout        attemptTimeout
 	Jitter
-	Timeout
 }
 
 // Option is an option for Do().
 //
 // The following types implement Option:
 //
+// • AdaptiveThrottle
+//
 // • Attempts
 //
 // • Budget
 //
+// • BudgetGroup
+//
 // • ExpBackoff
 //
+// • ExpTimeout
+//
 // • Jitter
 //
+// • Log
+//
+// • MinAttemptTime
+//
+// • RandSource
+//
+// • Resumable
+//
+// • RetryableStatusCodes
+//
+// • SplitTimeout
+//
 // • Timeout
+//
+// • TokenBudget
+//
+// • Tracing
 type Option interface {
 	apply(*internalOptions)
 }
@@ -84,11 +145,35 @@ func (opt Attempts) apply(opts *internalOptions) {
 // retry logic continues without waiting for the callback to return, though, so
 // callbacks should be thread-safe.
 //
+// The cause of the cancellation is an *AttemptTimeoutError, see
+// context.Cause(). See ExpTimeout and SplitTimeout for timeouts that vary
+// between attempts.
+//
 // Implements the Option interface.
 type Timeout time.Duration
 
 func (opt Timeout) apply(opts *internalOptions) {
-	opts.Timeout = opt
+	opts.timeout = opt
+}
+
+func (opt Timeout) timeout(context.Context, int, *internalOptions) time.Duration {
+	return time.Duration(opt)
+}
+
+// MinAttemptTime is the minimum time an attempt needs to have a chance to
+// succeed. If the context has a deadline and the time remaining after the
+// next backoff pause is less than MinAttemptTime, Do() gives up right away
+// instead of pausing into the deadline. The returned error wraps the error
+// of the last attempt and matches context.DeadlineExceeded, see errors.Is().
+//
+// The zero value gives up only if the deadline expires before the backoff
+// pause ends.
+//
+// Implements the Option interface.
+type MinAttemptTime time.Duration
+
+func (opt MinAttemptTime) apply(opts *internalOptions) {
+	opts.minAttemptTime = time.Duration(opt)
 }
 
 // Error is an error type that controls retry behavior. If Temporary() returns
@@ -118,10 +203,110 @@ func Abort(err error) Error {
 	return permanentError{err}
 }
 
+// temporaryError marks an error as temporary. Some errors that are worth
+// retrying, for example syscall.ECONNRESET, report that they are not
+// temporary.
+type temporaryError struct {
+	error
+}
+
+func (temporaryError) Temporary() bool { return true }
+
+func (e temporaryError) Unwrap() error {
+	return e.error
+}
+
+// unwrapTemporary returns the error wrapped by temporaryError, if any, and err
+// otherwise.
+func unwrapTemporary(err error) error {
+	switch e := err.(type) {
+	case temporaryError:
+		return e.error
+	case deadlineError:
+		return deadlineError{unwrapTemporary(e.error)}
+	case contextError:
+		e.err = unwrapTemporary(e.err)
+		return e
+	}
+	return err
+}
+
+// contextError is returned when the context is done after an attempt failed.
+// It wraps both the cause of the cancellation, see context.Cause(), and the
+// error of the last attempt, so that errors.Is() and errors.As() match
+// either.
+type contextError struct {
+	cause error
+	err   error
+}
+
+func (e contextError) Error() string {
+	return e.cause.Error() + " (last error: " + e.err.Error() + ")"
+}
+
+func (e contextError) Unwrap() []error {
+	return []error{e.cause, e.err}
+}
+
+// ctxDone returns the error returned when ctx is done. err is the error of the
+// last attempt, if any.
+func ctxDone(ctx context.Context, err error) error {
+	cause := context.Cause(ctx)
+	if err == nil {
+		return cause
+	}
+	return contextError{cause: cause, err: err}
+}
+
+// deadlineError is returned when the context's deadline does not leave enough
+// time for another attempt. It wraps the error of the last attempt and matches
+// context.DeadlineExceeded.
+type deadlineError struct {
+	error
+}
+
+func (e deadlineError) Error() string {
+	return "giving up before the context deadline: " + e.error.Error()
+}
+
+func (deadlineError) Is(target error) bool {
+	return target == context.DeadlineExceeded
+}
+
+func (e deadlineError) Unwrap() error {
+	return e.error
+}
+
 type ctxKey struct{}
 
-func withAttempt(ctx context.Context, attempt int) context.Context {
-	return context.WithValue(ctx, ctxKey{}, attempt)
+// attemptState is the state of an attempt, stored in the context passed to
+// the callback.
+type attemptState struct {
+	attempt     int
+	maxAttempts Attempts
+	lastErr     error
+	first       time.Time
+	// status is the status code of the HTTP response received by the
+	// attempt, set by Transport.
+	status atomic.Int64
+}
+
+func withAttempt(ctx context.Context, s *attemptState) context.Context {
+	return context.WithValue(ctx, ctxKey{}, s)
+}
+
+// attemptFromContext returns the state of the attempt, or nil if ctx is not
+// the context of an attempt.
+func attemptFromContext(ctx context.Context) *attemptState {
+	s, _ := ctx.Value(ctxKey{}).(*attemptState)
+	return s
+}
+
+// setAttemptStatus records the HTTP status code received by the attempt.
+func setAttemptStatus(ctx context.Context, code int) {
+	if s := attemptFromContext(ctx); s != nil {
+		s.status.Store(int64(code))
+	}
 }
 
 // Attempt returns the number of previous attempts. In other words, it returns
@@ -129,18 +314,80 @@ func withAttempt(ctx context.Context, attempt int) context.Context {
 //
 // Only call this function from within a retried function.
 func Attempt(ctx context.Context) int {
-	i := ctx.Value(ctxKey{})
-	if i == nil {
+	s := attemptFromContext(ctx)
+	if s == nil {
 		return 0
 	}
 
-	return i.(int)
+	return s.attempt
+}
+
+// AttemptDetails describes the current attempt, see AttemptInfo().
+type AttemptDetails struct {
+	// Attempt is the zero-based index of the attempt, see Attempt().
+	Attempt int
+
+	// MaxAttempts is the maximum number of attempts, or zero if the number
+	// of attempts is unlimited.
+	MaxAttempts int
+
+	// LastErr is the error returned by the previous attempt, or nil for
+	// the first attempt.
+	LastErr error
+
+	// Elapsed is the time since the first attempt started.
+	Elapsed time.Duration
+
+	// Deadline is the deadline of this attempt, including the per-attempt
+	// timeout, or the zero time if the attempt has no deadline.
+	Deadline time.Time
+}
+
+// IsLast returns true if this is the last attempt, i.e. the call fails if this
+// attempt fails. The retry budget may end the call before the last attempt.
+func (d AttemptDetails) IsLast() bool {
+	return d.MaxAttempts != 0 && d.Attempt+1 >= d.MaxAttempts
+}
+
+// AttemptInfo returns information about the current attempt. Callbacks can
+// use it to adapt to the retry state, for example to switch to a cheaper
+// fallback on the last attempt:
+//
+//	err := retry.Do(ctx, func(ctx context.Context) error {
+//	  if retry.AttemptInfo(ctx).IsLast() {
+//	    return fallback(ctx)
+//	  }
+//	  return query(ctx)
+//	})
+//
+// Only call this function from within a retried function. Otherwise, the zero
+// value is returned, except for Deadline.
+func AttemptInfo(ctx context.Context) AttemptDetails {
+	var d AttemptDetails
+	d.Deadline, _ = ctx.Deadline()
+
+	s := attemptFromContext(ctx)
+	if s == nil {
+		return d
+	}
+
+	d.Attempt = s.attempt
+	d.MaxAttempts = int(s.maxAttempts)
+	d.LastErr = s.lastErr
+	d.Elapsed = time.Since(s.first)
+
+	return d
 }
 
 // Do repeatedly calls cb until it succeeds. After cb fails (returns a non-nil
 // error), execution is paused for an exponentially increasing time. Execution
 // can be cancelled at any time by cancelling the context.
 //
+// When the context is done, Do() returns the cause of the cancellation, see
+// context.Cause(). If an attempt has failed before, the returned error wraps
+// both the cause and the error of the last attempt, so that errors.Is() and
+// errors.As() match either.
+//
 // By default, this function behaves as if the following options were passed:
 //
 //	Attempts(4),
@@ -150,7 +397,39 @@ func Attempt(ctx context.Context) int {
 //	  Factor: 2.0,
 //	},
 //	FullJitter,
+//
+// Options that only apply to HTTP requests, i.e. BudgetGroup,
+// RetryableStatusCodes and Resumable(true), cause Do() to return
+// ErrTransportOnly without calling cb.
 func Do(ctx context.Context, cb func(context.Context) error, opts ...Option) error {
+	intOpts := newOptions(opts)
+	if err := intOpts.checkNotTransport(); err != nil {
+		return err
+	}
+
+	return do(ctx, cb, intOpts)
+}
+
+// ErrTransportOnly is returned by Do() when it is passed an option that only
+// Transport implements.
+var ErrTransportOnly = errors.New("option is only supported by Transport")
+
+// checkNotTransport returns an error if opts contains an option that only
+// Transport implements.
+func (opts *internalOptions) checkNotTransport() error {
+	switch {
+	case opts.budgetGroup != nil:
+		return fmt.Errorf("BudgetGroup: %w", ErrTransportOnly)
+	case opts.retryableStatusCodes != nil:
+		return fmt.Errorf("RetryableStatusCodes: %w", ErrTransportOnly)
+	case opts.resumable:
+		return fmt.Errorf("Resumable: %w", ErrTransportOnly)
+	}
+	return nil
+}
+
+// newOptions returns the default options with opts applied.
+func newOptions(opts []Option) internalOptions {
 	intOpts := internalOptions{
 		Attempts: Attempts(4),
 		backoff: ExpBackoff{
@@ -165,64 +444,133 @@ func Do(ctx context.Context, cb func(context.Context) error, opts ...Option) err
 		o.apply(&intOpts)
 	}
 
-	return do(ctx, cb, intOpts)
+	return intOpts
+}
+
+// randSource returns the RandSource option or, if it is not set, the
+// RandSource of the Budget.
+func (opts *internalOptions) randSource() RandSource {
+	if opts.rand != nil {
+		return opts.rand
+	}
+	return opts.budgetRand
 }
 
 // ErrExhausted is returned by Do() when the retry budget is exhausted.
 var ErrExhausted = errors.New("retry budget exhausted")
 
 func do(ctx context.Context, cb func(context.Context) error, opts internalOptions) error {
+	for _, o := range opts.observers {
+		ctx = o.start(ctx)
+	}
+
+	attempts, err := loop(ctx, cb, opts)
+
+	for _, o := range opts.observers {
+		o.done(ctx, attempts, err)
+	}
+
+	return err
+}
+
+// loop implements do(). It returns the number of times cb has been called in
+// addition to the error.
+func loop(ctx context.Context, cb func(context.Context) error, opts internalOptions) (int, error) {
 	ch := make(chan error)
 
-	var err error
+	if v, ok := opts.budget.(interface{ Validate() error }); ok {
+		if err := v.Validate(); err != nil {
+			return 0, err
+		}
+	}
+
+	var (
+		err   error
+		first = time.Now()
+	)
 	for i := 0; Attempts(i) < opts.Attempts || opts.Attempts == 0; i++ {
-		ctx := withAttempt(ctx, i)
+		ctx := withAttempt(ctx, &attemptState{
+			attempt:     i,
+			maxAttempts: opts.Attempts,
+			lastErr:     err,
+			first:       first,
+		})
+
+		if !opts.throttle.sendOK() {
+			return i, ErrThrottled
+		}
+		if opts.budget != nil && !opts.budget.sendOK(i != 0 || opts.resumed) {
+			return i, ErrExhausted
+		}
 
-		if !opts.budget.sendOK(i != 0) {
-			return ErrExhausted
+		cbCtx := ctx
+		var ends []func(error)
+		for _, o := range opts.observers {
+			if ao, ok := o.(attemptObserver); ok {
+				var end func(error)
+				cbCtx, end = ao.attempt(cbCtx, i)
+				ends = append(ends, end)
+			}
 		}
 
-		go func(ctx context.Context) {
-			if opts.Timeout != 0 {
-				ch <- callWithTimeout(ctx, cb, opts.Timeout)
+		go func(ctx context.Context, attempt int) {
+			if opts.timeout != nil {
+				ch <- callWithTimeout(ctx, cb, attempt, &opts)
 			} else {
 				ch <- cb(ctx)
 			}
-		}(ctx)
+		}(cbCtx, i)
 
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
+			for _, end := range ends {
+				end(ctx.Err())
+			}
+			return i + 1, ctxDone(ctx, err)
 		case err = <-ch:
+			for _, end := range ends {
+				end(err)
+			}
+			opts.throttle.done(err)
 			if err == nil {
-				return nil
+				return i + 1, nil
 			}
 			if retryErr, ok := err.(Error); ok && !retryErr.Temporary() {
 				if p, ok := err.(permanentError); ok {
-					return p.error
+					return i + 1, p.error
 				}
-				return err
+				return i + 1, err
 			}
 		}
 
 		delay := opts.delay(i)
-		delay = opts.jitter(delay)
+		delay = opts.jitter(delay, opts.randSource())
+
+		// Don't pause if the deadline expires before the next attempt
+		// had a chance to complete.
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay+opts.minAttemptTime {
+			return i + 1, deadlineError{err}
+		}
+
+		for _, o := range opts.observers {
+			o.backoff(ctx, i, err, delay)
+		}
 
 		ticker := time.NewTicker(delay)
 		select {
 		case <-ctx.Done():
 			ticker.Stop()
-			return ctx.Err()
+			return i + 1, ctxDone(ctx, err)
 		case <-ticker.C:
 			ticker.Stop()
 		}
 	}
 
-	return err
+	return int(opts.Attempts), err
 }
 
-func callWithTimeout(ctx context.Context, cb func(context.Context) error, timeout Timeout) error {
-	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout))
+func callWithTimeout(ctx context.Context, cb func(context.Context) error, attempt int, opts *internalOptions) error {
+	ctx, cancel := withAttemptTimeout(ctx, attempt, opts)
 	defer cancel()
 
 	ch := make(chan error)
@@ -233,7 +581,7 @@ func callWithTimeout(ctx context.Context, cb func(context.Context) error, timeou
 
 	select {
 	case <-ctx.Done():
-		return ctx.Err()
+		return context.Cause(ctx)
 	case err := <-ch:
 		return err
 	}
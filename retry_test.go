@@ -2,6 +2,7 @@ package retry
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -74,17 +75,20 @@ func TestCancelInCallback(t *testing.T) {
 func TestCancelInTimer(t *testing.T) {
 	t.Parallel()
 
+	// Cancel the context during the third backoff pause, from 300ms to 700ms.
+	// Deadlines end the call before pausing, see TestDeadlineGiveUp.
 	want := 500 * time.Millisecond
-	ctx, cancel := context.WithTimeout(context.Background(), want)
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	time.AfterFunc(want, cancel)
 
 	cb := func(ctx context.Context) error {
 		return fmt.Errorf("oh no")
 	}
 
 	start := time.Now()
-	if err := Do(ctx, cb, WithoutJitter); err != context.DeadlineExceeded {
-		t.Errorf("Do() = %v, want %v", err, context.DeadlineExceeded)
+	if err := Do(ctx, cb, WithoutJitter); !errors.Is(err, context.Canceled) {
+		t.Errorf("Do() = %v, want %v", err, context.Canceled)
 	}
 	got := time.Since(start)
 
@@ -93,6 +97,55 @@ func TestCancelInTimer(t *testing.T) {
 	}
 }
 
+func TestDeadlineGiveUp(t *testing.T) {
+	t.Parallel()
+
+	errFailed := errors.New("oh no")
+	cb := func(ctx context.Context) error {
+		return errFailed
+	}
+
+	cases := []struct {
+		name string
+		opts []Option
+		// want is the time Do() returns. The deadline is after 500ms;
+		// backoff pauses end after 100ms, 300ms and 700ms.
+		want time.Duration
+	}{
+		{
+			name: "default",
+			opts: []Option{WithoutJitter},
+			want: 300 * time.Millisecond,
+		},
+		{
+			name: "MinAttemptTime",
+			opts: []Option{WithoutJitter, MinAttemptTime(250 * time.Millisecond)},
+			want: 100 * time.Millisecond,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			err := Do(ctx, cb, tc.opts...)
+			got := time.Since(start)
+
+			if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, errFailed) {
+				t.Errorf("Do() = %v, want an error matching %v and %v", err, context.DeadlineExceeded, errFailed)
+			}
+			if !durationEqual(got, tc.want) {
+				t.Errorf("got = %v, want = %v", got, tc.want)
+			}
+		})
+	}
+}
+
 func TestAbort(t *testing.T) {
 	t.Parallel()
 
@@ -244,3 +297,112 @@ func ExampleAttempts() {
 		log.Printf("cb() = %v", err)
 	}
 }
+
+func TestAttemptInfo(t *testing.T) {
+	t.Parallel()
+
+	var got []AttemptDetails
+	err := Do(context.Background(), func(ctx context.Context) error {
+		info := AttemptInfo(ctx)
+		got = append(got, info)
+		if info.IsLast() {
+			return nil
+		}
+		return fmt.Errorf("attempt %d failed", info.Attempt)
+	}, Attempts(3), rpcTestBackoff, WithoutJitter, Timeout(time.Minute))
+	if err != nil {
+		t.Fatalf("Do() = %v", err)
+	}
+
+	if len(got) != 3 {
+		t.Fatalf("got %d attempts, want 3", len(got))
+	}
+
+	for i, info := range got {
+		if info.Attempt != i || info.MaxAttempts != 3 {
+			t.Errorf("attempt %d: Attempt = %d, MaxAttempts = %d, want %d, 3", i, info.Attempt, info.MaxAttempts, i)
+		}
+		if info.IsLast() != (i == 2) {
+			t.Errorf("attempt %d: IsLast() = %v, want %v", i, info.IsLast(), i == 2)
+		}
+
+		var wantErr string
+		if i > 0 {
+			wantErr = fmt.Sprintf("attempt %d failed", i-1)
+		}
+		if (info.LastErr == nil) != (wantErr == "") || (info.LastErr != nil && info.LastErr.Error() != wantErr) {
+			t.Errorf("attempt %d: LastErr = %v, want %q", i, info.LastErr, wantErr)
+		}
+
+		if info.Deadline.IsZero() || time.Until(info.Deadline) > time.Minute {
+			t.Errorf("attempt %d: Deadline = %v, want within the next minute", i, info.Deadline)
+		}
+	}
+
+	if got[2].Elapsed < 2*time.Millisecond {
+		t.Errorf("Elapsed = %v, want at least 2ms after two backoff pauses", got[2].Elapsed)
+	}
+
+	if info := AttemptInfo(context.Background()); info != (AttemptDetails{}) {
+		t.Errorf("AttemptInfo(context.Background()) = %+v, want zero value", info)
+	}
+}
+
+func TestCancelCause(t *testing.T) {
+	t.Parallel()
+
+	errCause := errors.New("shutting down")
+	errFailed := errors.New("503 Service Unavailable")
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	err := Do(ctx, func(ctx context.Context) error {
+		if Attempt(ctx) == 1 {
+			cancel(errCause)
+		}
+		return errFailed
+	}, rpcTestBackoff, WithoutJitter)
+
+	if !errors.Is(err, errCause) || !errors.Is(err, errFailed) {
+		t.Errorf("Do() = %v, want an error matching %v and %v", err, errCause, errFailed)
+	}
+	if errors.Is(err, context.Canceled) {
+		t.Errorf("Do() = %v, want the custom cause instead of %v", err, context.Canceled)
+	}
+
+	// Without a previous error, the cause is returned as is.
+	ctx, cancel = context.WithCancelCause(context.Background())
+	cancel(errCause)
+	if err := Do(ctx, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}); err != errCause {
+		t.Errorf("Do() = %v, want %v", err, errCause)
+	}
+}
+
+func TestDoTransportOnly(t *testing.T) {
+	cases := []Option{
+		&BudgetGroup{},
+		RetryableStatusCodes{503},
+		Resumable(true),
+	}
+
+	for _, opt := range cases {
+		err := Do(context.Background(), func(context.Context) error {
+			t.Errorf("Do(%T) called the callback", opt)
+			return nil
+		}, opt)
+		if !errors.Is(err, ErrTransportOnly) {
+			t.Errorf("Do(%T) = %v, want %v", opt, err, ErrTransportOnly)
+		}
+	}
+
+	// Disabling an option is fine.
+	if err := Do(context.Background(), func(context.Context) error {
+		return nil
+	}, Resumable(false)); err != nil {
+		t.Errorf("Do(Resumable(false)) = %v", err)
+	}
+}
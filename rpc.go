@@ -0,0 +1,180 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/rpc"
+	"reflect"
+	"sync"
+)
+
+// RPCClient is a retrying wrapper around a "net/rpc".Client. Calls are made
+// via Do(), i.e. they are retried with backoff, and options such as Budget and
+// Timeout apply.
+//
+// Errors are handled as follows:
+//
+// • rpc.ErrShutdown and unexpected EOFs indicate that the connection has been
+// lost. RPCClient establishes a new connection and retries the call.
+//
+// • rpc.ServerError, i.e. errors returned by the remote method, are treated as
+// permanent failures by default. Set TemporaryServerError to retry some of
+// them.
+//
+// • All other errors, for example context deadlines, are retried.
+//
+// Calls are retried, so remote methods should be idempotent. Each attempt
+// decodes its reply into a new value, which is copied to the caller's reply
+// when Call returns successfully. The late reply of an attempt that has been
+// cancelled, for example because of the Timeout option, is discarded.
+type RPCClient struct {
+	// TemporaryServerError reports whether an error returned by the
+	// remote method is temporary. If nil, all errors returned by the remote
+	// method are permanent.
+	TemporaryServerError func(rpc.ServerError) bool
+
+	dial func() (*rpc.Client, error)
+	opts []Option
+
+	mu     sync.Mutex
+	client *rpc.Client
+}
+
+// NewRPCClient initializes a new RPCClient with the provided options. dial is
+// called to establish a connection, for example:
+//
+//	c := NewRPCClient(func() (*rpc.Client, error) {
+//		return rpc.Dial("tcp", "backend:1234")
+//	}, Attempts(5))
+//
+// The connection is established lazily by the first call.
+func NewRPCClient(dial func() (*rpc.Client, error), opts ...Option) *RPCClient {
+	c := &RPCClient{
+		dial: dial,
+	}
+	c.opts = append(c.opts, opts...)
+
+	return c
+}
+
+func (c *RPCClient) conn() (*rpc.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client != nil {
+		return c.client, nil
+	}
+
+	client, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.client = client
+
+	return client, nil
+}
+
+// reset closes client and causes the next call to establish a new connection.
+func (c *RPCClient) reset(client *rpc.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == client {
+		c.client = nil
+	}
+	client.Close()
+}
+
+// Call calls the named function, waits for it to complete, and returns its
+// error status. It is the retrying equivalent of "net/rpc".Client.Call.
+func (c *RPCClient) Call(ctx context.Context, serviceMethod string, args, reply any) error {
+	var (
+		mu     sync.Mutex
+		result any
+		done   bool
+	)
+
+	err := Do(ctx, func(ctx context.Context) error {
+		client, err := c.conn()
+		if err != nil {
+			return err
+		}
+
+		attemptReply := newReply(reply)
+		call := client.Go(serviceMethod, args, attemptReply, make(chan *rpc.Call, 1))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-call.Done:
+		}
+
+		var srvErr rpc.ServerError
+		switch err := call.Error; {
+		case err == nil:
+			mu.Lock()
+			defer mu.Unlock()
+
+			// Do() does not wait for cancelled attempts. Discard
+			// replies received by them.
+			if done || ctx.Err() != nil {
+				return ctx.Err()
+			}
+			result = attemptReply
+			return nil
+		case errors.Is(err, rpc.ErrShutdown) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+			c.reset(client)
+			return err
+		case errors.As(err, &srvErr):
+			if c.TemporaryServerError != nil && c.TemporaryServerError(srvErr) {
+				return err
+			}
+			return Abort(err)
+		default:
+			return err
+		}
+	}, c.opts...)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	done = true
+	if err != nil {
+		return err
+	}
+
+	setReply(reply, result)
+	return nil
+}
+
+// newReply returns a new value of the type reply points to. If reply is not a
+// non-nil pointer, it is returned as is and net/rpc reports the error.
+func newReply(reply any) any {
+	v := reflect.ValueOf(reply)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return reply
+	}
+	return reflect.New(v.Type().Elem()).Interface()
+}
+
+// setReply copies the reply of a successful attempt to the caller's reply.
+func setReply(reply, attemptReply any) {
+	if reply == attemptReply {
+		return
+	}
+	reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(attemptReply).Elem())
+}
+
+// Close closes the connection, if any.
+func (c *RPCClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		return nil
+	}
+
+	err := c.client.Close()
+	c.client = nil
+	return err
+}
@@ -0,0 +1,206 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func ExampleRPCClient() {
+	c := NewRPCClient(func() (*rpc.Client, error) {
+		return rpc.Dial("tcp", "backend.example.com:1234")
+	}, Attempts(5), Timeout(time.Second))
+	defer c.Close()
+
+	var reply int
+	if err := c.Call(context.Background(), "Counter.Add", 1, &reply); err != nil {
+		log.Printf("Call() = %v", err)
+	}
+}
+
+// Counter is the service used to test RPCClient.
+type Counter struct {
+	mu    sync.Mutex
+	calls int
+
+	// fail is the number of calls that fail with a server error.
+	fail int
+	// delay is the number of calls that are delayed by one second.
+	delay int
+}
+
+func (c *Counter) Add(n int, reply *int) error {
+	c.mu.Lock()
+	c.calls++
+	calls := c.calls
+	c.mu.Unlock()
+
+	if calls <= c.fail {
+		return errors.New("temporarily unavailable")
+	}
+	if calls <= c.delay {
+		time.Sleep(time.Second)
+	}
+
+	*reply = calls + n
+	return nil
+}
+
+func (c *Counter) Calls() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.calls
+}
+
+type rpcTestServer struct {
+	srv *rpc.Server
+
+	mu    sync.Mutex
+	dials int
+	conns []net.Conn
+}
+
+func newRPCTestServer(t *testing.T, svc *Counter) *rpcTestServer {
+	t.Helper()
+
+	srv := rpc.NewServer()
+	if err := srv.Register(svc); err != nil {
+		t.Fatal(err)
+	}
+
+	return &rpcTestServer{srv: srv}
+}
+
+func (s *rpcTestServer) dial() (*rpc.Client, error) {
+	client, server := net.Pipe()
+	go s.srv.ServeConn(server)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dials++
+	s.conns = append(s.conns, server)
+
+	return rpc.NewClient(client), nil
+}
+
+// closeConns simulates a server restart.
+func (s *rpcTestServer) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+var rpcTestBackoff = ExpBackoff{
+	Base:   time.Millisecond,
+	Max:    time.Millisecond,
+	Factor: 1.0,
+}
+
+func TestRPCClient(t *testing.T) {
+	ctx := context.Background()
+	svc := &Counter{}
+	srv := newRPCTestServer(t, svc)
+
+	c := NewRPCClient(srv.dial, rpcTestBackoff)
+	defer c.Close()
+
+	var reply int
+	if err := c.Call(ctx, "Counter.Add", 10, &reply); err != nil {
+		t.Fatalf("Call() = %v", err)
+	}
+	if got, want := reply, 11; got != want {
+		t.Errorf("reply = %d, want %d", got, want)
+	}
+
+	// The connection is lost, the client reconnects.
+	srv.closeConns()
+
+	if err := c.Call(ctx, "Counter.Add", 10, &reply); err != nil {
+		t.Fatalf("Call() = %v", err)
+	}
+	if got, want := reply, 12; got != want {
+		t.Errorf("reply = %d, want %d", got, want)
+	}
+	if got, want := srv.dials, 2; got != want {
+		t.Errorf("dials = %d, want %d", got, want)
+	}
+}
+
+func TestRPCClientServerError(t *testing.T) {
+	ctx := context.Background()
+
+	svc := &Counter{fail: 2}
+	c := NewRPCClient(newRPCTestServer(t, svc).dial, rpcTestBackoff)
+	defer c.Close()
+
+	var reply int
+	err := c.Call(ctx, "Counter.Add", 10, &reply)
+	var srvErr rpc.ServerError
+	if !errors.As(err, &srvErr) {
+		t.Fatalf("Call() = %v, want rpc.ServerError", err)
+	}
+	if got, want := svc.Calls(), 1; got != want {
+		t.Errorf("calls = %d, want %d", got, want)
+	}
+
+	c.TemporaryServerError = func(err rpc.ServerError) bool {
+		return strings.Contains(err.Error(), "temporarily")
+	}
+	if err := c.Call(ctx, "Counter.Add", 10, &reply); err != nil {
+		t.Fatalf("Call() = %v", err)
+	}
+	if got, want := reply, 13; got != want {
+		t.Errorf("reply = %d, want %d", got, want)
+	}
+}
+
+func TestRPCClientOptions(t *testing.T) {
+	ctx := context.Background()
+
+	svc := &Counter{delay: 1}
+	c := NewRPCClient(newRPCTestServer(t, svc).dial, rpcTestBackoff, Timeout(50*time.Millisecond))
+	defer c.Close()
+
+	var reply0 int
+	if err := c.Call(ctx, "Counter.Add", 10, &reply0); err != nil {
+		t.Fatalf("Call() = %v", err)
+	}
+	if got, want := svc.Calls(), 2; got != want {
+		t.Errorf("calls = %d, want %d", got, want)
+	}
+	if got, want := reply0, 12; got != want {
+		t.Errorf("reply = %d, want %d", got, want)
+	}
+
+	// The late reply of the first, cancelled, attempt is discarded.
+	time.Sleep(1100 * time.Millisecond)
+	if got, want := reply0, 12; got != want {
+		t.Errorf("after the cancelled attempt completed, reply = %d, want %d", got, want)
+	}
+
+	// A budget with a zero ratio permits the first retry only.
+	svc = &Counter{fail: 2}
+	c = NewRPCClient(newRPCTestServer(t, svc).dial, rpcTestBackoff, &Budget{Ratio: 0})
+	c.TemporaryServerError = func(rpc.ServerError) bool { return true }
+	defer c.Close()
+
+	var reply1 int
+	if err := c.Call(ctx, "Counter.Add", 10, &reply1); !errors.Is(err, ErrExhausted) {
+		t.Errorf("Call() = %v, want %v", err, ErrExhausted)
+	}
+	if got, want := svc.Calls(), 2; got != want {
+		t.Errorf("calls = %d, want %d", got, want)
+	}
+}
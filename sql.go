@@ -0,0 +1,555 @@
+package retry
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Driver is a "database/sql/driver".Driver that retries transient failures of
+// the wrapped driver. Establishing connections is always retried; statements,
+// including prepared statements, are only retried if they are idempotent and
+// not part of a transaction. Transactions are never retried midway.
+//
+// The following errors are considered temporary:
+//
+// • driver.ErrBadConn and connection resets. Since the connection is lost,
+// Driver establishes a new connection before retrying the statement.
+// Prepared statements are prepared again on the new connection.
+//
+// • While establishing a connection, errors that Dialer retries, for example
+// refused connections and unreachable hosts.
+//
+// • Errors for which IsTemporary returns true, for example serialization
+// failures reported with a driver-specific error code. Statements are
+// retried on the same connection.
+//
+// • Deadlines caused by the per-attempt timeout, see below, unless the
+// caller's context is done. Idempotent statements are retried on the same
+// connection. When starting a transaction times out, the transaction may have
+// been started nonetheless, so Driver establishes a new connection before
+// retrying.
+//
+// All other errors are permanent. Use the Driver with "database/sql" by
+// registering it or, preferably, by calling sql.OpenDB:
+//
+//	c, err := retry.NewDriver(&pq.Driver{}, retry.Attempts(3)).OpenConnector(dsn)
+//	if err != nil {
+//		// handle error
+//	}
+//	db := sql.OpenDB(c)
+//
+// The Timeout, ExpTimeout and SplitTimeout options limit each attempt via the
+// context passed to the wrapped driver. Unlike Do(), Driver waits for the
+// wrapped driver to return, since connections must not be used concurrently.
+type Driver struct {
+	driver.Driver
+
+	// IsTemporary reports whether a driver-specific error is temporary.
+	// If nil, only driver.ErrBadConn and connection resets are temporary.
+	IsTemporary func(error) bool
+
+	// IsIdempotent reports whether query may safely be executed more than
+	// once. If nil, queries starting with SELECT, SHOW, EXPLAIN, DESCRIBE
+	// or VALUES are considered idempotent.
+	IsIdempotent func(query string) bool
+
+	opts []Option
+}
+
+// NewDriver initializes a new Driver wrapping d with the provided options.
+func NewDriver(d driver.Driver, opts ...Option) *Driver {
+	drv := &Driver{
+		Driver: d,
+	}
+	drv.opts = append(drv.opts, opts...)
+
+	return drv
+}
+
+// Open returns a new connection to the database, retrying failures. It
+// implements the "database/sql/driver".Driver interface.
+func (d *Driver) Open(name string) (driver.Conn, error) {
+	connect := func(context.Context) (driver.Conn, error) {
+		return d.Driver.Open(name)
+	}
+
+	return d.newConn(context.Background(), connect)
+}
+
+// OpenConnector implements the "database/sql/driver".DriverContext interface.
+// If the wrapped driver implements DriverContext, its connector is used.
+func (d *Driver) OpenConnector(name string) (driver.Connector, error) {
+	connect := func(context.Context) (driver.Conn, error) {
+		return d.Driver.Open(name)
+	}
+
+	if dc, ok := d.Driver.(driver.DriverContext); ok {
+		c, err := dc.OpenConnector(name)
+		if err != nil {
+			return nil, err
+		}
+		connect = c.Connect
+	}
+
+	return &connector{
+		driver:  d,
+		connect: connect,
+	}, nil
+}
+
+type connector struct {
+	driver  *Driver
+	connect func(context.Context) (driver.Conn, error)
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.newConn(ctx, c.connect)
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
+
+// do calls cb via do(). In contrast to Do(), do waits for cb to return, even if
+// ctx is done or the per-attempt timeout expires.
+func (d *Driver) do(ctx context.Context, cb func(context.Context) error) error {
+	opts := newOptions(d.opts)
+	if err := opts.checkNotTransport(); err != nil {
+		return err
+	}
+	timeoutOpts := opts
+	opts.timeout = nil
+
+	var (
+		mu       sync.Mutex
+		returned bool
+	)
+	err := do(ctx, func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if returned {
+			return ctx.Err()
+		}
+
+		ctx, cancel := withAttemptTimeout(ctx, Attempt(ctx), &timeoutOpts)
+		defer cancel()
+
+		return cb(ctx)
+	}, opts)
+
+	// do() returns when ctx is done, without waiting for cb.
+	mu.Lock()
+	returned = true
+	mu.Unlock()
+
+	return unwrapTemporary(err)
+}
+
+func (d *Driver) newConn(ctx context.Context, connect func(context.Context) (driver.Conn, error)) (driver.Conn, error) {
+	c := &conn{
+		driver:  d,
+		connect: connect,
+	}
+
+	err := d.do(ctx, func(ctx context.Context) error {
+		conn, err := connect(ctx)
+		if err != nil {
+			return d.classifyConnect(ctx, err)
+		}
+
+		c.Conn = conn
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// badConn reports whether err indicates that the connection has been lost.
+func badConn(err error) bool {
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// attemptTimedOut reports whether err is a deadline caused by the per-attempt
+// timeout of ctx, as opposed to the deadline of the caller's context.
+func attemptTimedOut(ctx context.Context, err error) bool {
+	var timeoutErr *AttemptTimeoutError
+	return errors.Is(err, context.DeadlineExceeded) && errors.As(context.Cause(ctx), &timeoutErr)
+}
+
+// classify wraps err in temporaryError if it is temporary and with Abort()
+// otherwise. ctx is the context of the attempt that returned err.
+func (d *Driver) classify(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if badConn(err) || attemptTimedOut(ctx, err) || (d.IsTemporary != nil && d.IsTemporary(err)) {
+		return temporaryError{err}
+	}
+	return Abort(err)
+}
+
+// classifyConnect is like classify for errors establishing a connection. In
+// addition, errors retried by Dialer are temporary.
+func (d *Driver) classifyConnect(ctx context.Context, err error) error {
+	if err != nil && dialRetryable(err) {
+		return temporaryError{err}
+	}
+	return d.classify(ctx, err)
+}
+
+func (d *Driver) isIdempotent(query string) bool {
+	if d.IsIdempotent != nil {
+		return d.IsIdempotent(query)
+	}
+
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return false
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case "SELECT", "SHOW", "EXPLAIN", "DESCRIBE", "VALUES":
+		return true
+	}
+	return false
+}
+
+// conn wraps a driver.Conn and re-establishes the connection if it is lost
+// while executing an idempotent statement. database/sql does not use a
+// connection concurrently, so conn does not need to be thread-safe.
+type conn struct {
+	driver.Conn
+
+	driver  *Driver
+	connect func(context.Context) (driver.Conn, error)
+	inTx    bool
+}
+
+// retry calls cb with the underlying connection. Unless query is part of a
+// transaction or not idempotent, cb is retried.
+func (c *conn) retry(ctx context.Context, query string, cb func(context.Context, driver.Conn) error) error {
+	if c.Conn == nil {
+		return driver.ErrBadConn
+	}
+
+	if c.inTx || !c.driver.isIdempotent(query) {
+		return cb(ctx, c.Conn)
+	}
+
+	return c.retryAlways(ctx, true, cb)
+}
+
+// retryAlways calls cb with the underlying connection and retries temporary
+// failures. If the connection is lost, or if cb is not idempotent and the
+// attempt timed out, a new connection is established before retrying. If no
+// new connection could be established, IsValid reports false and database/sql
+// discards the connection.
+func (c *conn) retryAlways(ctx context.Context, idempotent bool, cb func(context.Context, driver.Conn) error) error {
+	return c.driver.do(ctx, func(ctx context.Context) error {
+		if c.Conn == nil {
+			conn, err := c.connect(ctx)
+			if err != nil {
+				return c.driver.classifyConnect(ctx, err)
+			}
+			c.Conn = conn
+		}
+
+		err := cb(ctx, c.Conn)
+		if err != nil && (badConn(err) || (!idempotent && attemptTimedOut(ctx, err))) {
+			c.Conn.Close()
+			c.Conn = nil
+		}
+
+		return c.driver.classify(ctx, err)
+	})
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+// PrepareContext prepares query. The returned statement is retried like
+// queries executed directly on the connection.
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var s *stmt
+	err := c.retry(ctx, query, func(ctx context.Context, conn driver.Conn) error {
+		st, err := prepare(ctx, conn, query)
+		if err != nil {
+			return err
+		}
+
+		s = &stmt{Stmt: st, conn: c, query: query, prepared: conn}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func prepare(ctx context.Context, conn driver.Conn, query string) (driver.Stmt, error) {
+	if cpc, ok := conn.(driver.ConnPrepareContext); ok {
+		return cpc.PrepareContext(ctx, query)
+	}
+	return conn.Prepare(query)
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if _, ok := c.Conn.(driver.ExecerContext); !ok {
+		return nil, driver.ErrSkip
+	}
+
+	var res driver.Result
+	err := c.retry(ctx, query, func(ctx context.Context, conn driver.Conn) error {
+		var err error
+		res, err = conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+		return err
+	})
+
+	return res, err
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if _, ok := c.Conn.(driver.QueryerContext); !ok {
+		return nil, driver.ErrSkip
+	}
+
+	var rows driver.Rows
+	err := c.retry(ctx, query, func(ctx context.Context, conn driver.Conn) error {
+		var err error
+		rows, err = conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+		return err
+	})
+
+	return rows, err
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx starts a transaction. Starting the transaction is retried, since no
+// statement has been executed yet. Statements within the transaction are not
+// retried.
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if c.Conn == nil {
+		return nil, driver.ErrBadConn
+	}
+
+	var t driver.Tx
+	err := c.retryAlways(ctx, false, func(ctx context.Context, conn driver.Conn) error {
+		var err error
+		if cbt, ok := conn.(driver.ConnBeginTx); ok {
+			t, err = cbt.BeginTx(ctx, opts)
+		} else {
+			//lint:ignore SA1019 fallback for drivers not implementing ConnBeginTx
+			t, err = conn.Begin() //nolint:staticcheck
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.inTx = true
+	return &tx{Tx: t, conn: c}, nil
+}
+
+func (c *conn) Close() error {
+	if c.Conn == nil {
+		return nil
+	}
+	return c.Conn.Close()
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	if c.Conn == nil {
+		return driver.ErrBadConn
+	}
+
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *conn) ResetSession(ctx context.Context) error {
+	if c.Conn == nil {
+		return driver.ErrBadConn
+	}
+
+	if sr, ok := c.Conn.(driver.SessionResetter); ok {
+		return sr.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *conn) IsValid() bool {
+	if c.Conn == nil {
+		return false
+	}
+
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *conn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nvc, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// tx marks the connection as no longer being in a transaction when the
+// transaction ends.
+type tx struct {
+	driver.Tx
+	conn *conn
+}
+
+func (t *tx) Commit() error {
+	t.conn.inTx = false
+	return t.Tx.Commit()
+}
+
+func (t *tx) Rollback() error {
+	t.conn.inTx = false
+	return t.Tx.Rollback()
+}
+
+// stmt wraps a driver.Stmt and retries it like conn retries queries. If the
+// connection is lost, the statement is prepared again on the new connection.
+// database/sql does not use a statement concurrently and holds the
+// connection while the statement is executed.
+type stmt struct {
+	driver.Stmt
+
+	conn  *conn
+	query string
+	// prepared is the connection Stmt has been prepared on.
+	prepared driver.Conn
+}
+
+// retry calls cb with the underlying statement. Unless the statement is
+// executed as part of a transaction or is not idempotent, cb is retried.
+func (s *stmt) retry(ctx context.Context, cb func(context.Context, driver.Stmt) error) error {
+	if s.conn.inTx || !s.conn.driver.isIdempotent(s.query) {
+		return cb(ctx, s.Stmt)
+	}
+
+	return s.conn.retryAlways(ctx, true, func(ctx context.Context, conn driver.Conn) error {
+		if conn != s.prepared {
+			st, err := prepare(ctx, conn, s.query)
+			if err != nil {
+				return err
+			}
+			s.Stmt.Close()
+			s.Stmt, s.prepared = st, conn
+		}
+
+		return cb(ctx, s.Stmt)
+	})
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	var res driver.Result
+	err := s.retry(context.Background(), func(_ context.Context, st driver.Stmt) error {
+		var err error
+		//lint:ignore SA1019 the wrapped driver may not implement StmtExecContext
+		res, err = st.Exec(args) //nolint:staticcheck
+		return err
+	})
+
+	return res, err
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	var rows driver.Rows
+	err := s.retry(context.Background(), func(_ context.Context, st driver.Stmt) error {
+		var err error
+		//lint:ignore SA1019 the wrapped driver may not implement StmtQueryContext
+		rows, err = st.Query(args) //nolint:staticcheck
+		return err
+	})
+
+	return rows, err
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	var res driver.Result
+	err := s.retry(ctx, func(ctx context.Context, st driver.Stmt) error {
+		if sec, ok := st.(driver.StmtExecContext); ok {
+			var err error
+			res, err = sec.ExecContext(ctx, args)
+			return err
+		}
+
+		values, err := namedValues(args)
+		if err != nil {
+			return err
+		}
+		//lint:ignore SA1019 fallback for drivers not implementing StmtExecContext
+		res, err = st.Exec(values) //nolint:staticcheck
+		return err
+	})
+
+	return res, err
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	var rows driver.Rows
+	err := s.retry(ctx, func(ctx context.Context, st driver.Stmt) error {
+		if sqc, ok := st.(driver.StmtQueryContext); ok {
+			var err error
+			rows, err = sqc.QueryContext(ctx, args)
+			return err
+		}
+
+		values, err := namedValues(args)
+		if err != nil {
+			return err
+		}
+		//lint:ignore SA1019 fallback for drivers not implementing StmtQueryContext
+		rows, err = st.Query(values) //nolint:staticcheck
+		return err
+	})
+
+	return rows, err
+}
+
+// CheckNamedValue implements the "database/sql/driver".NamedValueChecker
+// interface. database/sql only falls back to the connection's checker if the
+// statement does not implement the interface, so stmt does that itself.
+func (s *stmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if nvc, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	return s.conn.CheckNamedValue(nv)
+}
+
+// namedValues converts args for drivers that do not support named parameters.
+func namedValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("sql: driver does not support the use of Named Parameters")
+		}
+		values[i] = arg.Value
+	}
+
+	return values, nil
+}
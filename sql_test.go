@@ -0,0 +1,421 @@
+package retry
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeDriver is a "database/sql/driver".Driver simulating dropped
+// connections and driver-specific errors.
+type fakeDriver struct {
+	mu sync.Mutex
+	// failOpens is the number of calls to Open that fail with openErr,
+	// or with a connection reset if openErr is nil.
+	failOpens int
+	openErr   error
+	opens     int
+	// errs are returned by subsequent statements, in order.
+	errs       []error
+	statements []string
+}
+
+func (d *fakeDriver) Open(string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.opens++
+	if d.opens <= d.failOpens {
+		if d.openErr != nil {
+			return nil, d.openErr
+		}
+		return nil, syscall.ECONNRESET
+	}
+
+	return &fakeConn{driver: d, id: d.opens}, nil
+}
+
+// errBlock causes a statement to block until its context is done.
+var errBlock = errors.New("block until the context is done")
+
+// statement records query and returns the next error, if any. If the next
+// error is errBlock, statement waits for ctx and returns its error.
+func (d *fakeDriver) statement(ctx context.Context, query string) error {
+	if err := d.next(query); err != errBlock {
+		return err
+	}
+
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (d *fakeDriver) next(query string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.statements = append(d.statements, query)
+	if len(d.errs) == 0 {
+		return nil
+	}
+
+	err := d.errs[0]
+	d.errs = d.errs[1:]
+	return err
+}
+
+func (d *fakeDriver) Statements() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.statements)
+}
+
+type fakeConn struct {
+	driver *fakeDriver
+	// id is the number of the connection, starting at one.
+	id     int
+	closed bool
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	if c.closed {
+		return nil, driver.ErrBadConn
+	}
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(ctx context.Context, _ driver.TxOptions) (driver.Tx, error) {
+	if c.closed {
+		return nil, driver.ErrBadConn
+	}
+	if err := c.driver.statement(ctx, "BEGIN"); err != nil {
+		return nil, err
+	}
+	return fakeTx{c}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	if c.closed {
+		return nil, driver.ErrBadConn
+	}
+	if err := c.driver.statement(ctx, query); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	if c.closed {
+		return nil, driver.ErrBadConn
+	}
+	if err := c.driver.statement(ctx, query); err != nil {
+		return nil, err
+	}
+	return &fakeRows{id: c.id}, nil
+}
+
+// fakeStmt is a prepared statement of fakeConn. It only implements the legacy
+// methods without context.
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	return s.conn.ExecContext(context.Background(), s.query, nil)
+}
+
+func (s *fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	return s.conn.QueryContext(context.Background(), s.query, nil)
+}
+
+type fakeTx struct {
+	conn *fakeConn
+}
+
+func (tx fakeTx) Commit() error   { return tx.conn.driver.next("COMMIT") }
+func (tx fakeTx) Rollback() error { return tx.conn.driver.next("ROLLBACK") }
+
+// fakeRows returns a single row holding the ID of the connection.
+type fakeRows struct {
+	id   int
+	done bool
+}
+
+func (r *fakeRows) Columns() []string { return []string{"conn"} }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = int64(r.id)
+	return nil
+}
+
+// fakeCodeError is a driver-specific error with an error code.
+type fakeCodeError struct {
+	code string
+}
+
+func (err fakeCodeError) Error() string {
+	return fmt.Sprintf("error code %s", err.code)
+}
+
+func newTestDB(t *testing.T, d *Driver) *sql.DB {
+	t.Helper()
+
+	c, err := d.OpenConnector("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := sql.OpenDB(c)
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func TestDriverOpen(t *testing.T) {
+	fd := &fakeDriver{failOpens: 2}
+	db := newTestDB(t, NewDriver(fd, rpcTestBackoff))
+
+	if err := db.Ping(); err != nil {
+		t.Fatalf("Ping() = %v", err)
+	}
+	if got, want := fd.opens, 3; got != want {
+		t.Errorf("opens = %d, want %d", got, want)
+	}
+
+	fd = &fakeDriver{failOpens: 10}
+	db = newTestDB(t, NewDriver(fd, rpcTestBackoff, Attempts(2)))
+	if err := db.Ping(); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Ping() = %v, want %v", err, syscall.ECONNRESET)
+	}
+
+	// Refused connections are retried, too.
+	fd = &fakeDriver{failOpens: 2, openErr: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}
+	db = newTestDB(t, NewDriver(fd, rpcTestBackoff))
+	if err := db.Ping(); err != nil {
+		t.Fatalf("Ping() = %v", err)
+	}
+	if got, want := fd.opens, 3; got != want {
+		t.Errorf("opens = %d, want %d", got, want)
+	}
+}
+
+func TestDriverStmt(t *testing.T) {
+	ctx := context.Background()
+
+	fd := &fakeDriver{}
+	db := newTestDB(t, NewDriver(fd, rpcTestBackoff))
+	db.SetMaxOpenConns(1)
+
+	s, err := db.PrepareContext(ctx, "SELECT conn")
+	if err != nil {
+		t.Fatalf("Prepare() = %v", err)
+	}
+	defer s.Close()
+
+	// The connection is reset; the statement is prepared again and
+	// retried on a new connection.
+	fd.errs = []error{syscall.ECONNRESET}
+	var id int
+	if err := s.QueryRowContext(ctx).Scan(&id); err != nil {
+		t.Fatalf("QueryRow() = %v", err)
+	}
+	if id != 2 {
+		t.Errorf("conn = %d, want 2", id)
+	}
+
+	// Statements that are not idempotent are not retried.
+	s, err = db.PrepareContext(ctx, "INSERT INTO t VALUES (1)")
+	if err != nil {
+		t.Fatalf("Prepare() = %v", err)
+	}
+	defer s.Close()
+
+	fd.errs = []error{syscall.ECONNRESET}
+	before := fd.Statements()
+	if _, err := s.ExecContext(ctx); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Exec() = %v, want %v", err, syscall.ECONNRESET)
+	}
+	if got, want := fd.Statements()-before, 1; got != want {
+		t.Errorf("executed %d statements, want %d", got, want)
+	}
+}
+
+func TestDriverQuery(t *testing.T) {
+	ctx := context.Background()
+
+	fd := &fakeDriver{}
+	db := newTestDB(t, NewDriver(fd, rpcTestBackoff))
+	db.SetMaxOpenConns(1)
+
+	var id int
+	if err := db.QueryRowContext(ctx, "SELECT conn").Scan(&id); err != nil {
+		t.Fatalf("QueryRow() = %v", err)
+	}
+	if id != 1 {
+		t.Errorf("conn = %d, want 1", id)
+	}
+
+	// The connection is reset; the query is retried on a new connection.
+	fd.errs = []error{syscall.ECONNRESET}
+	if err := db.QueryRowContext(ctx, "  select conn").Scan(&id); err != nil {
+		t.Fatalf("QueryRow() = %v", err)
+	}
+	if id != 2 {
+		t.Errorf("conn = %d, want 2", id)
+	}
+
+	// Statements that are not idempotent are not retried.
+	fd.errs = []error{syscall.ECONNRESET}
+	before := fd.Statements()
+	if _, err := db.ExecContext(ctx, "INSERT INTO t VALUES (1)"); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Exec() = %v, want %v", err, syscall.ECONNRESET)
+	}
+	if got, want := fd.Statements()-before, 1; got != want {
+		t.Errorf("executed %d statements, want %d", got, want)
+	}
+}
+
+func TestDriverIsTemporary(t *testing.T) {
+	ctx := context.Background()
+
+	fd := &fakeDriver{}
+	d := NewDriver(fd, rpcTestBackoff)
+	db := newTestDB(t, d)
+
+	// Unknown errors are permanent.
+	fd.errs = []error{fakeCodeError{"40001"}}
+	if _, err := db.ExecContext(ctx, "SELECT 1"); !errors.As(err, new(fakeCodeError)) {
+		t.Errorf("Exec() = %v, want fakeCodeError", err)
+	}
+	if got, want := fd.Statements(), 1; got != want {
+		t.Errorf("executed %d statements, want %d", got, want)
+	}
+
+	d.IsTemporary = func(err error) bool {
+		var codeErr fakeCodeError
+		return errors.As(err, &codeErr) && codeErr.code == "40001"
+	}
+	d.IsIdempotent = func(string) bool { return true }
+
+	fd.errs = []error{fakeCodeError{"40001"}, fakeCodeError{"40001"}}
+	if _, err := db.ExecContext(ctx, "UPDATE t SET x = 1"); err != nil {
+		t.Errorf("Exec() = %v", err)
+	}
+	if got, want := fd.Statements(), 4; got != want {
+		t.Errorf("executed %d statements, want %d", got, want)
+	}
+	// Temporary errors that are not connection errors are retried on the
+	// same connection.
+	if got, want := fd.opens, 1; got != want {
+		t.Errorf("opens = %d, want %d", got, want)
+	}
+}
+
+func TestDriverTransaction(t *testing.T) {
+	ctx := context.Background()
+
+	fd := &fakeDriver{}
+	db := newTestDB(t, NewDriver(fd, rpcTestBackoff))
+	db.SetMaxOpenConns(1)
+
+	// Starting a transaction is retried.
+	fd.errs = []error{syscall.ECONNRESET}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() = %v", err)
+	}
+
+	// Statements within the transaction are not retried.
+	fd.errs = []error{syscall.ECONNRESET}
+	before := fd.Statements()
+	if _, err := tx.QueryContext(ctx, "SELECT 1"); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Query() = %v, want %v", err, syscall.ECONNRESET)
+	}
+	if got, want := fd.Statements()-before, 1; got != want {
+		t.Errorf("executed %d statements, want %d", got, want)
+	}
+	tx.Rollback()
+
+	// After the transaction, statements are retried again.
+	fd.errs = []error{syscall.ECONNRESET}
+	var id int
+	if err := db.QueryRowContext(ctx, "SELECT conn").Scan(&id); err != nil {
+		t.Fatalf("QueryRow() = %v", err)
+	}
+	if id != 3 {
+		t.Errorf("conn = %d, want 3", id)
+	}
+}
+
+func TestDriverTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	fd := &fakeDriver{}
+	db := newTestDB(t, NewDriver(fd, rpcTestBackoff, Timeout(20*time.Millisecond)))
+	db.SetMaxOpenConns(1)
+
+	// An idempotent statement that times out is retried on the same
+	// connection.
+	fd.errs = []error{errBlock}
+	var id int
+	if err := db.QueryRowContext(ctx, "SELECT conn").Scan(&id); err != nil {
+		t.Fatalf("QueryRow() = %v", err)
+	}
+	if got, want := fd.Statements(), 2; got != want {
+		t.Errorf("executed %d statements, want %d", got, want)
+	}
+	if id != 1 {
+		t.Errorf("conn = %d, want 1", id)
+	}
+
+	// Starting a transaction that times out is retried on a new
+	// connection, since the transaction may have been started.
+	fd.errs = []error{errBlock}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() = %v", err)
+	}
+	if got, want := fd.opens, 2; got != want {
+		t.Errorf("opens = %d, want %d", got, want)
+	}
+	tx.Rollback()
+
+	// The deadline of the caller's context is not retried.
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	fd = &fakeDriver{errs: []error{errBlock}}
+	db = newTestDB(t, NewDriver(fd, rpcTestBackoff, Timeout(time.Second)))
+	if err := db.QueryRowContext(ctx, "SELECT conn").Scan(&id); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("QueryRow() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if got, want := fd.Statements(), 1; got != want {
+		t.Errorf("executed %d statements, want %d", got, want)
+	}
+}
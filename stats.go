@@ -0,0 +1,142 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Stats holds statistics about a single call made by DoWithStats() or
+// Transport.
+type Stats struct {
+	// Attempts is the number of attempts made.
+	Attempts int
+
+	// Elapsed is the total duration of the call.
+	Elapsed time.Duration
+
+	// Backoff is the total time spent pausing between attempts.
+	Backoff time.Duration
+
+	// AttemptDurations holds the duration of each attempt, in order.
+	AttemptDurations []time.Duration
+
+	// Exhausted is true if the call ended because the retry budget refused
+	// a retry, see ErrExhausted.
+	Exhausted bool
+
+	// Throttled is true if the call was rejected by AdaptiveThrottle, see
+	// ErrThrottled.
+	Throttled bool
+
+	// ContextDone is true if the call ended because the context was
+	// cancelled or its deadline was exceeded, including when the deadline
+	// did not leave enough time for another attempt, see MinAttemptTime.
+	ContextDone bool
+}
+
+// DoWithStats is like Do() but also returns statistics about the call. The
+// statistics are returned even if the call fails.
+func DoWithStats(ctx context.Context, cb func(context.Context) error, opts ...Option) (Stats, error) {
+	intOpts := newOptions(opts)
+
+	r := &statsRecorder{}
+	intOpts.observers = append(intOpts.observers, r)
+
+	err := do(ctx, cb, intOpts)
+
+	return r.stats(), err
+}
+
+// ContextStats returns the statistics of the call made by Transport, given the
+// context of the response's request:
+//
+//	res, err := client.Do(req)
+//	if err != nil {
+//	  return err
+//	}
+//	stats, _ := retry.ContextStats(res.Request.Context())
+//
+// The second return value is false if ctx was not created by Transport. The
+// statistics are complete once Transport has returned the response.
+func ContextStats(ctx context.Context) (Stats, bool) {
+	r, ok := ctx.Value(statsKey{}).(*statsRecorder)
+	if !ok {
+		return Stats{}, false
+	}
+
+	return r.stats(), true
+}
+
+type statsKey struct{}
+
+// statsRecorder is an observer collecting Stats.
+type statsRecorder struct {
+	mu         sync.Mutex
+	s          Stats
+	callStart  time.Time
+	pauseStart time.Time
+}
+
+func (r *statsRecorder) stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.s
+	s.AttemptDurations = append([]time.Duration(nil), s.AttemptDurations...)
+	return s
+}
+
+// endPause adds the time since the last backoff to the backoff time.
+func (r *statsRecorder) endPause(now time.Time) {
+	if !r.pauseStart.IsZero() {
+		r.s.Backoff += now.Sub(r.pauseStart)
+		r.pauseStart = time.Time{}
+	}
+}
+
+func (r *statsRecorder) start(ctx context.Context) context.Context {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.callStart = time.Now()
+	return context.WithValue(ctx, statsKey{}, r)
+}
+
+func (r *statsRecorder) attempt(ctx context.Context, _ int) (context.Context, func(error)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	start := time.Now()
+	r.endPause(start)
+
+	return ctx, func(error) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		r.s.AttemptDurations = append(r.s.AttemptDurations, time.Since(start))
+	}
+}
+
+func (r *statsRecorder) backoff(context.Context, int, error, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pauseStart = time.Now()
+}
+
+func (r *statsRecorder) done(ctx context.Context, attempts int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.endPause(now)
+
+	r.s.Attempts = attempts
+	r.s.Elapsed = now.Sub(r.callStart)
+	r.s.Exhausted = errors.Is(err, ErrExhausted)
+	r.s.Throttled = errors.Is(err, ErrThrottled)
+	var de deadlineError
+	r.s.ContextDone = err != nil && (ctx.Err() != nil || errors.As(err, &de))
+}
@@ -0,0 +1,154 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func ExampleDoWithStats() {
+	stats, err := DoWithStats(context.Background(), func(ctx context.Context) error {
+		// Do something that may fail.
+		return nil
+	})
+
+	log.Printf("%d attempts in %v (%v backoff): %v", stats.Attempts, stats.Elapsed, stats.Backoff, err)
+}
+
+func ExampleContextStats() {
+	c := &http.Client{
+		Transport: &Transport{},
+	}
+
+	res, err := c.Get("http://example.com/")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if stats, ok := ContextStats(res.Request.Context()); ok {
+		log.Printf("GET took %d attempts", stats.Attempts)
+	}
+}
+
+func TestDoWithStats(t *testing.T) {
+	errFailed := errors.New("temporary failure")
+
+	var calls int
+	stats, err := DoWithStats(context.Background(), func(ctx context.Context) error {
+		calls++
+		time.Sleep(5 * time.Millisecond)
+		if calls < 3 {
+			return errFailed
+		}
+		return nil
+	}, ExpBackoff{Base: 10 * time.Millisecond, Max: 10 * time.Millisecond, Factor: 1}, WithoutJitter)
+	if err != nil {
+		t.Fatalf("DoWithStats() = %v", err)
+	}
+
+	if got, want := stats.Attempts, 3; got != want {
+		t.Errorf("Attempts = %d, want %d", got, want)
+	}
+	if got, want := len(stats.AttemptDurations), 3; got != want {
+		t.Fatalf("len(AttemptDurations) = %d, want %d", got, want)
+	}
+
+	var attempts time.Duration
+	for i, d := range stats.AttemptDurations {
+		if d < 5*time.Millisecond {
+			t.Errorf("AttemptDurations[%d] = %v, want at least 5ms", i, d)
+		}
+		attempts += d
+	}
+	if stats.Backoff < 20*time.Millisecond {
+		t.Errorf("Backoff = %v, want at least 20ms", stats.Backoff)
+	}
+	if stats.Elapsed < attempts+stats.Backoff {
+		t.Errorf("Elapsed = %v, want at least %v", stats.Elapsed, attempts+stats.Backoff)
+	}
+	if stats.Exhausted || stats.Throttled || stats.ContextDone {
+		t.Errorf("stats = %+v, want Exhausted, Throttled and ContextDone to be false", stats)
+	}
+}
+
+func TestDoWithStatsEnd(t *testing.T) {
+	errFailed := errors.New("temporary failure")
+	failing := func(context.Context) error { return errFailed }
+
+	// TokenBudget without deposits refuses all retries.
+	stats, err := DoWithStats(context.Background(), failing, rpcTestBackoff, &TokenBudget{})
+	if !errors.Is(err, ErrExhausted) {
+		t.Fatalf("DoWithStats() = %v, want %v", err, ErrExhausted)
+	}
+	if !stats.Exhausted || stats.ContextDone || stats.Attempts != 1 {
+		t.Errorf("stats = %+v, want Exhausted after 1 attempt", stats)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stats, err = DoWithStats(ctx, func(context.Context) error {
+		cancel()
+		return errFailed
+	}, rpcTestBackoff)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("DoWithStats() = %v, want %v", err, context.Canceled)
+	}
+	if !stats.ContextDone || stats.Exhausted {
+		t.Errorf("stats = %+v, want ContextDone", stats)
+	}
+
+	// Giving up before the deadline is attributed to the context.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	stats, err = DoWithStats(ctx, failing, MinAttemptTime(time.Hour))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("DoWithStats() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if !stats.ContextDone || stats.Attempts != 1 {
+		t.Errorf("stats = %+v, want ContextDone after 1 attempt", stats)
+	}
+
+	// Failures of the callback are not attributed to the context.
+	stats, err = DoWithStats(context.Background(), failing, Attempts(2), rpcTestBackoff)
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("DoWithStats() = %v, want %v", err, errFailed)
+	}
+	if stats.ContextDone || stats.Exhausted || stats.Attempts != 2 {
+		t.Errorf("stats = %+v, want 2 attempts and no other reason", stats)
+	}
+}
+
+func TestContextStatsTransport(t *testing.T) {
+	c := &http.Client{
+		Transport: NewTransport(&testTransport{status: []int{503, 502, 200}},
+			rpcTestBackoff, WithoutJitter),
+	}
+
+	res, err := c.Post("http://example.com/", "text/plain", strings.NewReader("request payload"))
+	if err != nil {
+		t.Fatalf("Post() = %v", err)
+	}
+	res.Body.Close()
+
+	stats, ok := ContextStats(res.Request.Context())
+	if !ok {
+		t.Fatal("ContextStats() = false, want true")
+	}
+	if got, want := stats.Attempts, 3; got != want {
+		t.Errorf("Attempts = %d, want %d", got, want)
+	}
+	if got, want := len(stats.AttemptDurations), 3; got != want {
+		t.Errorf("len(AttemptDurations) = %d, want %d", got, want)
+	}
+	if stats.Backoff < 2*time.Millisecond {
+		t.Errorf("Backoff = %v, want at least 2ms", stats.Backoff)
+	}
+
+	if _, ok := ContextStats(context.Background()); ok {
+		t.Error("ContextStats(context.Background()) = true, want false")
+	}
+}
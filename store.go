@@ -0,0 +1,406 @@
+package retry
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// BudgetStore shares the state of a Budget between processes, so that
+// replicas of a service enforce a global retry budget instead of each
+// enforcing its own.
+//
+// A Budget with a Store periodically, every Budget.SyncInterval, sends the
+// number of calls it made since the last exchange to the store and receives
+// the global rates in return. These global rates are used instead of the
+// local ones until they become stale, i.e. until three sync intervals pass
+// without a successful exchange. The global rates lag behind by up to one
+// sync interval and are therefore approximate.
+//
+// MemoryBudgetStore is an in-memory implementation. ServeBudgetStore and
+// DialBudgetStore share a BudgetStore between processes, for example via a
+// Unix domain socket.
+type BudgetStore interface {
+	// Sync adds the calls in req to the shared state identified by
+	// req.Key and returns the global rates. Sync may receive the same
+	// calls more than once; see BudgetSyncRequest.Seq.
+	Sync(ctx context.Context, req BudgetSyncRequest) (BudgetSyncResponse, error)
+}
+
+// BudgetSyncRequest holds the calls made by a Budget since its last exchange
+// with a BudgetStore.
+type BudgetSyncRequest struct {
+	// Key is the Budget.StoreKey of the sending budget.
+	Key string
+
+	// Window and Resolution are the moving window settings of the sending
+	// budget. The store uses them when it sees Key for the first time.
+	Window     time.Duration
+	Resolution time.Duration
+
+	// InitialCalls and RetriedCalls are the number of calls made since
+	// the last successful exchange.
+	InitialCalls int
+	RetriedCalls int
+
+	// Client identifies the sending budget, and Seq numbers its
+	// successful exchanges, starting at 1. If an exchange fails, for
+	// example because ctx expired, the calls are sent again with the same
+	// Seq, together with the calls made in the meantime. The store must
+	// only add the calls it has not added for Client and Seq before, so
+	// that calls are not counted twice if the failed request has been
+	// applied nonetheless.
+	//
+	// If Client is empty, the calls are always added.
+	Client string
+	Seq    uint64
+}
+
+// BudgetSyncResponse holds the global rates, in calls per second, as returned
+// by a BudgetStore.
+type BudgetSyncResponse struct {
+	InitialRate float64
+	RetryRate   float64
+}
+
+type globalRates struct {
+	initialRate, retriedRate float64
+	// time of the exchange, in Unix nanoseconds
+	time int64
+}
+
+func (b *Budget) syncInterval() time.Duration {
+	if b.SyncInterval == 0 {
+		return time.Second
+	}
+	return b.SyncInterval
+}
+
+// globalRates returns the rates received from Store, or nil if they are
+// stale or the budget is not shared.
+func (b *Budget) globalRates(t time.Time) *globalRates {
+	if b.Store == nil {
+		return nil
+	}
+
+	g := b.global.Load()
+	if g == nil || time.Duration(t.UnixNano()-g.time) > 3*b.syncInterval() {
+		return nil
+	}
+	return g
+}
+
+// maybeSync starts an exchange with Store in the background if the last
+// exchange is at least one sync interval ago.
+func (b *Budget) maybeSync(t time.Time) {
+	last := b.lastSync.Load()
+	if time.Duration(t.UnixNano()-last) < b.syncInterval() {
+		return
+	}
+	if !b.syncing.CompareAndSwap(false, true) {
+		return
+	}
+	b.lastSync.Store(t.UnixNano())
+
+	go func() {
+		defer b.syncing.Store(false)
+
+		ctx, cancel := context.WithTimeout(context.Background(), b.syncInterval())
+		defer cancel()
+
+		b.sync(ctx)
+	}()
+}
+
+// sync exchanges the pending calls with Store. If the exchange fails, the calls
+// are kept and sent again with the same sequence number, so that the store does
+// not count them twice if the failed request has been applied.
+func (b *Budget) sync(ctx context.Context) error {
+	req := BudgetSyncRequest{
+		Key:          b.StoreKey,
+		Window:       b.window(),
+		Resolution:   b.resolution(),
+		InitialCalls: int(b.pendingInitial.Load()),
+		RetriedCalls: int(b.pendingRetried.Load()),
+		Client:       b.storeClient,
+		Seq:          b.storeSeq.Load(),
+	}
+
+	res, err := b.Store.Sync(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	b.pendingInitial.Add(-int64(req.InitialCalls))
+	b.pendingRetried.Add(-int64(req.RetriedCalls))
+	b.storeSeq.Add(1)
+
+	b.global.Store(&globalRates{
+		initialRate: res.InitialRate,
+		retriedRate: res.RetryRate,
+		time:        time.Now().UnixNano(),
+	})
+	return nil
+}
+
+// MemoryBudgetStore is an in-memory BudgetStore. It is the reference
+// implementation and can be used to share budgets between processes with
+// ServeBudgetStore.
+//
+// The zero value is ready to use.
+type MemoryBudgetStore struct {
+	mu      sync.Mutex
+	budgets map[string]*storedBudget
+}
+
+type storedBudget struct {
+	initialCalls *movingRate
+	retriedCalls *movingRate
+
+	mu      sync.Mutex
+	clients map[string]*syncClient
+}
+
+// syncClient is the last exchange with a client, see
+// BudgetSyncRequest.Client.
+type syncClient struct {
+	seq                        uint64
+	initialCalls, retriedCalls int
+	seen                       time.Time
+}
+
+// newStoreClientID returns a random identifier for BudgetSyncRequest.Client.
+func newStoreClientID() string {
+	var id [16]byte
+	if _, err := cryptorand.Read(id[:]); err != nil {
+		// Fall back to the time, which is unique enough on one host.
+		binary.BigEndian.PutUint64(id[:], uint64(time.Now().UnixNano()))
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// unseen returns the calls in req that have not been added before, and records
+// the exchange.
+func (sb *storedBudget) unseen(req BudgetSyncRequest, t time.Time, window time.Duration) (initialCalls, retriedCalls int) {
+	if req.Client == "" {
+		return req.InitialCalls, req.RetriedCalls
+	}
+
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	// Forget clients that have not been seen for longer than the window.
+	// Calls they send again are added again, but have left the window by
+	// then.
+	for id, c := range sb.clients {
+		if t.Sub(c.seen) > window {
+			delete(sb.clients, id)
+		}
+	}
+
+	c, ok := sb.clients[req.Client]
+	switch {
+	case !ok:
+		if sb.clients == nil {
+			sb.clients = make(map[string]*syncClient)
+		}
+		c = &syncClient{}
+		sb.clients[req.Client] = c
+	case req.Seq < c.seq:
+		// A late copy of an exchange that has been superseded.
+		return 0, 0
+	case req.Seq == c.seq:
+		// A repeated exchange: only add the calls made since.
+		initialCalls = req.InitialCalls - c.initialCalls
+		retriedCalls = req.RetriedCalls - c.retriedCalls
+		c.initialCalls = max(c.initialCalls, req.InitialCalls)
+		c.retriedCalls = max(c.retriedCalls, req.RetriedCalls)
+		c.seen = t
+		return initialCalls, retriedCalls
+	}
+
+	c.seq = req.Seq
+	c.initialCalls, c.retriedCalls = req.InitialCalls, req.RetriedCalls
+	c.seen = t
+	return req.InitialCalls, req.RetriedCalls
+}
+
+// Sync implements the BudgetStore interface.
+func (s *MemoryBudgetStore) Sync(_ context.Context, req BudgetSyncRequest) (BudgetSyncResponse, error) {
+	sb, err := s.budget(req)
+	if err != nil {
+		return BudgetSyncResponse{}, err
+	}
+
+	t := time.Now()
+	initialCalls, retriedCalls := sb.unseen(req, t, sb.initialCalls.window())
+	if initialCalls > 0 {
+		sb.initialCalls.Add(t, initialCalls)
+	}
+	if retriedCalls > 0 {
+		sb.retriedCalls.Add(t, retriedCalls)
+	}
+
+	return BudgetSyncResponse{
+		InitialRate: sb.initialCalls.Rate(t),
+		RetryRate:   sb.retriedCalls.Rate(t),
+	}, nil
+}
+
+func (s *MemoryBudgetStore) budget(req BudgetSyncRequest) (*storedBudget, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sb, ok := s.budgets[req.Key]; ok {
+		return sb, nil
+	}
+
+	b := Budget{
+		Window:     req.Window,
+		Resolution: req.Resolution,
+	}
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+
+	if s.budgets == nil {
+		s.budgets = make(map[string]*storedBudget)
+	}
+	sb := &storedBudget{
+		initialCalls: newMovingRate(b.window(), b.resolution()),
+		retriedCalls: newMovingRate(b.window(), b.resolution()),
+	}
+	s.budgets[req.Key] = sb
+
+	return sb, nil
+}
+
+// budgetStoreService exports a BudgetStore via "net/rpc".
+type budgetStoreService struct {
+	store BudgetStore
+}
+
+func (s budgetStoreService) Sync(req BudgetSyncRequest, res *BudgetSyncResponse) error {
+	r, err := s.store.Sync(context.Background(), req)
+	if err != nil {
+		return err
+	}
+
+	*res = r
+	return nil
+}
+
+const budgetStoreServiceName = "retry.BudgetStore"
+
+// ServeBudgetStore accepts connections on l and serves store to clients
+// created with DialBudgetStore. It blocks until l is closed and returns the
+// error returned by l.Accept().
+func ServeBudgetStore(l net.Listener, store BudgetStore) error {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName(budgetStoreServiceName, budgetStoreService{store}); err != nil {
+		return err
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.ServeConn(conn)
+	}
+}
+
+// RemoteBudgetStore is a BudgetStore served by another process via
+// ServeBudgetStore. If the connection is lost, it is re-established with the
+// next call to Sync.
+type RemoteBudgetStore struct {
+	network, address string
+
+	mu     sync.Mutex
+	client *rpc.Client
+}
+
+// DialBudgetStore connects to a BudgetStore served by ServeBudgetStore at the
+// given network address, for example:
+//
+//	store, err := DialBudgetStore("unix", "/run/foo/budget.sock")
+func DialBudgetStore(network, address string) (*RemoteBudgetStore, error) {
+	s := &RemoteBudgetStore{
+		network: network,
+		address: address,
+	}
+
+	if _, err := s.conn(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *RemoteBudgetStore) conn() (*rpc.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	c, err := rpc.Dial(s.network, s.address)
+	if err != nil {
+		return nil, err
+	}
+	s.client = c
+
+	return c, nil
+}
+
+// Sync implements the BudgetStore interface. If ctx is done before the remote
+// store responds, Sync returns ctx.Err(), but the request may still be applied.
+func (s *RemoteBudgetStore) Sync(ctx context.Context, req BudgetSyncRequest) (BudgetSyncResponse, error) {
+	c, err := s.conn()
+	if err != nil {
+		return BudgetSyncResponse{}, err
+	}
+
+	var res BudgetSyncResponse
+	call := c.Go(budgetStoreServiceName+".Sync", req, &res, make(chan *rpc.Call, 1))
+
+	select {
+	case <-ctx.Done():
+		return BudgetSyncResponse{}, ctx.Err()
+	case <-call.Done:
+	}
+
+	// Errors other than rpc.ServerError indicate a problem with the
+	// connection. Reconnect with the next call.
+	var srvErr rpc.ServerError
+	if call.Error != nil && !errors.As(call.Error, &srvErr) {
+		s.mu.Lock()
+		if s.client == c {
+			c.Close()
+			s.client = nil
+		}
+		s.mu.Unlock()
+	}
+
+	return res, call.Error
+}
+
+// Close closes the connection to the remote store.
+func (s *RemoteBudgetStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client == nil {
+		return nil
+	}
+
+	err := s.client.Close()
+	s.client = nil
+	return err
+}
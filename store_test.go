@@ -0,0 +1,220 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func ExampleBudgetStore() {
+	// All processes on this host share the "foo" budget via a Unix domain
+	// socket served by one of them, or by a sidecar running:
+	//
+	//	l, err := net.Listen("unix", "/run/foo/budget.sock")
+	//	if err != nil {
+	//		log.Fatal(err)
+	//	}
+	//	log.Fatal(ServeBudgetStore(l, &MemoryBudgetStore{}))
+	store, err := DialBudgetStore("unix", "/run/foo/budget.sock")
+	if err != nil {
+		return
+	}
+	defer store.Close()
+
+	fooRetryBudget := &Budget{
+		Rate:     1.0,
+		Ratio:    0.1,
+		Store:    store,
+		StoreKey: "foo",
+	}
+	_ = fooRetryBudget // pass to Do() or NewTransport()
+}
+
+// testBudgetStore checks that two budgets, i.e. two simulated processes,
+// share their state via store.
+func testBudgetStore(t *testing.T, store0, store1 BudgetStore) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	// b0 only makes initial calls, b1 only retries.
+	b0 := &Budget{Ratio: 0.5, Store: store0, StoreKey: "test", SyncInterval: time.Hour}
+	b1 := &Budget{Ratio: 0.5, Store: store1, StoreKey: "test", SyncInterval: time.Hour}
+	b0.init()
+	b1.init()
+
+	for i := 0; i < 10; i++ {
+		b0.sendOK(false)
+	}
+	if err := b0.sync(ctx); err != nil {
+		t.Fatalf("sync() = %v", err)
+	}
+
+	var got int
+	for i := 0; i < 20; i++ {
+		if b1.sendOK(true) {
+			got++
+		}
+		if err := b1.sync(ctx); err != nil {
+			t.Fatalf("sync() = %v", err)
+		}
+	}
+
+	// b1 has no initial calls of its own. The global ratio permits ~5
+	// retries for the 10 initial calls made by b0.
+	if got < 4 || got > 6 {
+		t.Errorf("got %d permitted retries, want 5±1", got)
+	}
+
+	stats := b0.Stats()
+	if stats.InitialRate <= 0 || stats.RetryRate != 0 {
+		t.Errorf("b0.Stats() = %+v, want positive InitialRate and zero RetryRate", stats)
+	}
+	if err := b0.sync(ctx); err != nil {
+		t.Fatalf("sync() = %v", err)
+	}
+	if stats := b0.Stats(); stats.RetryRate <= 0 {
+		t.Errorf("after sync, b0.Stats() = %+v, want positive RetryRate", stats)
+	}
+}
+
+func TestMemoryBudgetStore(t *testing.T) {
+	store := &MemoryBudgetStore{}
+	testBudgetStore(t, store, store)
+}
+
+func TestRemoteBudgetStore(t *testing.T) {
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "budget.sock"))
+	if err != nil {
+		t.Skipf("Unix domain sockets are not supported: %v", err)
+	}
+	defer l.Close()
+
+	go ServeBudgetStore(l, &MemoryBudgetStore{})
+
+	var stores []BudgetStore
+	for i := 0; i < 2; i++ {
+		s, err := DialBudgetStore(l.Addr().Network(), l.Addr().String())
+		if err != nil {
+			t.Fatalf("DialBudgetStore() = %v", err)
+		}
+		defer s.Close()
+
+		stores = append(stores, s)
+	}
+
+	testBudgetStore(t, stores[0], stores[1])
+}
+
+type failingBudgetStore struct{}
+
+func (failingBudgetStore) Sync(context.Context, BudgetSyncRequest) (BudgetSyncResponse, error) {
+	return BudgetSyncResponse{}, errors.New("store unavailable")
+}
+
+func TestBudgetStoreFailure(t *testing.T) {
+	b := &Budget{Ratio: 0.5, Store: failingBudgetStore{}, SyncInterval: time.Hour}
+	b.init()
+
+	for i := 0; i < 10; i++ {
+		b.sendOK(false)
+	}
+	if err := b.sync(context.Background()); err == nil {
+		t.Fatal("sync() = nil, want error")
+	}
+
+	// pending calls are kept for the next exchange
+	if got, want := b.pendingInitial.Load(), int64(10); got != want {
+		t.Errorf("pendingInitial = %d, want %d", got, want)
+	}
+
+	// the budget falls back to local rates
+	if !b.sendOK(true) {
+		t.Error("sendOK(true) = false, want true")
+	}
+}
+
+func TestMemoryBudgetStoreRepeatedSync(t *testing.T) {
+	var store MemoryBudgetStore
+	ctx := context.Background()
+
+	sync := func(initialCalls int, seq uint64) float64 {
+		t.Helper()
+		_, err := store.Sync(ctx, BudgetSyncRequest{
+			Key:          "test",
+			InitialCalls: initialCalls,
+			Client:       "client",
+			Seq:          seq,
+		})
+		if err != nil {
+			t.Fatalf("Sync() = %v", err)
+		}
+		return store.budgets["test"].initialCalls.countAt(time.Now().UnixNano())
+	}
+
+	cases := []struct {
+		name         string
+		initialCalls int
+		seq          uint64
+		want         float64
+	}{
+		{"first", 10, 1, 10},
+		{"repeated", 10, 1, 10},
+		{"repeated with new calls", 15, 1, 15},
+		{"next", 5, 2, 20},
+		{"superseded", 15, 1, 20},
+	}
+
+	for _, c := range cases {
+		if got := sync(c.initialCalls, c.seq); got != c.want {
+			t.Errorf("%s: initial calls = %g, want %g", c.name, got, c.want)
+		}
+	}
+}
+
+// timeoutBudgetStore applies requests to a MemoryBudgetStore, but reports an
+// error for the first failures requests, like a remote store whose responses
+// time out.
+type timeoutBudgetStore struct {
+	MemoryBudgetStore
+	failures int
+}
+
+func (s *timeoutBudgetStore) Sync(ctx context.Context, req BudgetSyncRequest) (BudgetSyncResponse, error) {
+	res, err := s.MemoryBudgetStore.Sync(ctx, req)
+	if err == nil && s.failures > 0 {
+		s.failures--
+		return BudgetSyncResponse{}, context.DeadlineExceeded
+	}
+	return res, err
+}
+
+func TestBudgetStoreTimeout(t *testing.T) {
+	store := &timeoutBudgetStore{failures: 1}
+	b := &Budget{Ratio: 0.5, Store: store, StoreKey: "test", SyncInterval: time.Hour}
+	b.init()
+	ctx := context.Background()
+
+	for i := 0; i < 10; i++ {
+		b.sendOK(false)
+	}
+	if err := b.sync(ctx); err == nil {
+		t.Fatal("sync() = nil, want error")
+	}
+
+	b.sendOK(false)
+	if err := b.sync(ctx); err != nil {
+		t.Fatalf("sync() = %v", err)
+	}
+	if got, want := b.pendingInitial.Load(), int64(0); got != want {
+		t.Errorf("pendingInitial = %d, want %d", got, want)
+	}
+
+	// The calls of the timed out exchange are counted once.
+	if got, want := store.budgets["test"].initialCalls.countAt(time.Now().UnixNano()), 11.0; got != want {
+		t.Errorf("stored initial calls = %g, want %g", got, want)
+	}
+}
@@ -0,0 +1,132 @@
+package retry
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrThrottled is returned by Do() when AdaptiveThrottle rejects a call locally.
+var ErrThrottled = errors.New("call rejected by adaptive throttling")
+
+// AdaptiveThrottle implements client-side adaptive throttling as described in
+// the "Handling Overload" chapter of the SRE book.
+//
+// AdaptiveThrottle counts the number of calls ("requests") and the number of
+// calls accepted by the backend ("accepts") over a moving one minute window,
+// the same window used by Budget. When the backend starts rejecting calls,
+// calls are rejected locally with probability
+//
+//	max(0, (requests - K * accepts) / (requests + 1))
+//
+// Unlike Budget, AdaptiveThrottle also rejects initial calls, not only retries.
+// Do() returns ErrThrottled in this case. Locally rejected calls are counted
+// as requests, so the rejection probability keeps adapting while the backend
+// is not contacted.
+//
+// A call is considered accepted if the backend responded, i.e. if the callback
+// succeeds or fails with a permanent error. Temporary errors, which cause the
+// call to be retried, are taken as a sign of backend overload. Network errors,
+// i.e. errors implementing net.Error, are never accepts, even when they are
+// permanent: Transport, for example, aborts when the connection is refused,
+// but the backend has not answered the call.
+//
+// AdaptiveThrottle is checked before the retry budget, so that locally
+// rejected calls don't use up the budget.
+//
+// To throttle calls to a specific service or backend, declare an
+// AdaptiveThrottle variable that is shared by all Do() calls and Transports
+// talking to that backend.
+//
+// Implements the Option interface.
+type AdaptiveThrottle struct {
+	// K is the multiplier applied to the number of accepts. Lower values
+	// throttle more aggressively. The SRE book recommends 2.0, which is
+	// also used when K is zero.
+	K float64
+
+	// Rand is the source of randomness used to reject calls. Defaults to
+	// a shared, concurrency-safe generator. See RandSource.
+	Rand RandSource
+
+	once     sync.Once
+	requests *movingRate
+	accepts  *movingRate
+}
+
+func (at *AdaptiveThrottle) apply(opts *internalOptions) {
+	opts.throttle = at
+}
+
+func (at *AdaptiveThrottle) k() float64 {
+	if at.K == 0 {
+		return 2.0
+	}
+	return at.K
+}
+
+func (at *AdaptiveThrottle) init() {
+	at.once.Do(func() {
+		at.requests = newMovingRate(defaultWindow, defaultResolution)
+		at.accepts = newMovingRate(defaultWindow, defaultResolution)
+	})
+}
+
+// probability returns the probability with which a call is rejected.
+func (at *AdaptiveThrottle) probability(t time.Time) float64 {
+	requests := at.requests.Count(t)
+	accepts := at.accepts.Count(t)
+
+	p := (requests - at.k()*accepts) / (requests + 1)
+	if p < 0 {
+		return 0
+	}
+	return p
+}
+
+// sendOK checks if a call should be sent to the backend. All calls, including
+// rejected ones, are accounted as requests.
+func (at *AdaptiveThrottle) sendOK() bool {
+	if at == nil {
+		return true
+	}
+
+	at.init()
+
+	t := time.Now()
+
+	p := at.probability(t)
+	at.requests.Add(t, 1)
+
+	return p == 0 || at.Rand.float64() >= p
+}
+
+// done records the result of a call that has been sent to the backend.
+func (at *AdaptiveThrottle) done(err error) {
+	if at == nil {
+		return
+	}
+
+	if !accepted(err) {
+		return
+	}
+
+	at.init()
+	at.accepts.Add(time.Now(), 1)
+}
+
+// accepted reports whether err, the result of a call, indicates that the
+// backend received and answered the call.
+func accepted(err error) bool {
+	if err == nil {
+		return true
+	}
+
+	if retryErr, ok := err.(Error); !ok || retryErr.Temporary() {
+		return false
+	}
+
+	var netErr net.Error
+	return !errors.As(err, &netErr)
+}
@@ -0,0 +1,155 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func ExampleAdaptiveThrottle() {
+	ctx := context.Background()
+
+	// fooThrottle is a global variable holding the state of the adaptive
+	// throttle for the "foo" backend. It is shared by all calls to foo.
+	var fooThrottle AdaptiveThrottle
+
+	// rpc is a fake RPC call that may or may not fail.
+	rpc := func(_ context.Context) error {
+		return nil // or error
+	}
+
+	if err := Do(ctx, rpc, &fooThrottle); errors.Is(err, ErrThrottled) {
+		log.Println("foo is overloaded, rejected call locally")
+	}
+}
+
+func TestAdaptiveThrottleProbability(t *testing.T) {
+	cases := []struct {
+		k        float64
+		requests int
+		accepts  int
+		want     float64
+	}{
+		{requests: 0, accepts: 0, want: 0},
+		{requests: 100, accepts: 100, want: 0},
+		{requests: 100, accepts: 50, want: 0},
+		{requests: 100, accepts: 40, want: 20.0 / 101.0},
+		{requests: 100, accepts: 0, want: 100.0 / 101.0},
+		{k: 1.0, requests: 100, accepts: 90, want: 10.0 / 101.0},
+		{k: 1.5, requests: 100, accepts: 40, want: 40.0 / 101.0},
+	}
+
+	for _, c := range cases {
+		at := &AdaptiveThrottle{
+			K:        c.k,
+			requests: newMovingRate(defaultWindow, defaultResolution),
+			accepts:  newMovingRate(defaultWindow, defaultResolution),
+		}
+
+		tm := time.Date(2018, time.February, 22, 22, 24, 53, 0, time.UTC)
+		at.requests.Add(tm, c.requests)
+		at.accepts.Add(tm, c.accepts)
+
+		if got := at.probability(tm); math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("AdaptiveThrottle{K: %g}.probability() = %g, want %g (requests = %d, accepts = %d)",
+				c.k, got, c.want, c.requests, c.accepts)
+		}
+	}
+}
+
+func TestAdaptiveThrottle(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	at := &AdaptiveThrottle{}
+
+	var calls int
+	cb := func(_ context.Context) error {
+		calls++
+		return errors.New("overloaded")
+	}
+
+	var throttled int
+	for i := 0; i < 1000; i++ {
+		err := Do(ctx, cb, Attempts(1), at)
+		if errors.Is(err, ErrThrottled) {
+			throttled++
+		}
+	}
+
+	if calls+throttled != 1000 {
+		t.Errorf("calls + throttled = %d, want 1000", calls+throttled)
+	}
+
+	// With no accepts, the rejection probability quickly converges to 1.
+	if calls > 100 {
+		t.Errorf("calls = %d, want at most 100", calls)
+	}
+}
+
+func TestAdaptiveThrottleAccepts(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	at := &AdaptiveThrottle{}
+
+	for _, cbErr := range []error{nil, Abort(errors.New("permanent"))} {
+		for i := 0; i < 100; i++ {
+			cb := func(_ context.Context) error {
+				return cbErr
+			}
+
+			if err := Do(ctx, cb, Attempts(1), at); errors.Is(err, ErrThrottled) {
+				t.Fatalf("Do(%v) = %v, want call not to be throttled", cbErr, err)
+			}
+		}
+	}
+}
+
+func TestAdaptiveThrottleNetworkErrors(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	at := &AdaptiveThrottle{}
+
+	// Transport aborts when the connection is refused. The backend has not
+	// answered, so these calls are not accepts.
+	cbErr := Abort(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED})
+
+	var calls int
+	for i := 0; i < 1000; i++ {
+		Do(ctx, func(context.Context) error {
+			calls++
+			return cbErr
+		}, Attempts(1), at)
+	}
+
+	if calls > 100 {
+		t.Errorf("calls = %d, want at most 100", calls)
+	}
+}
+
+func TestAdaptiveThrottleBeforeBudget(t *testing.T) {
+	at := &AdaptiveThrottle{}
+	at.init()
+	at.requests.Add(time.Now(), math.MaxInt32)
+
+	var budget recordingLimiter
+	err := Do(context.Background(), func(context.Context) error {
+		t.Error("callback called, want call to be throttled")
+		return nil
+	}, at, &budget)
+	if !errors.Is(err, ErrThrottled) {
+		t.Fatalf("Do() = %v, want %v", err, ErrThrottled)
+	}
+
+	// Locally rejected calls don't use the budget.
+	if len(budget.retries) != 0 {
+		t.Errorf("budget calls = %v, want none", budget.retries)
+	}
+}
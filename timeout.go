@@ -0,0 +1,154 @@
+package retry
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// attemptTimeout determines the timeout of each attempt.
+type attemptTimeout interface {
+	// timeout returns the timeout of attempt, or zero if the attempt has no
+	// timeout. ctx is the context of the attempt.
+	timeout(ctx context.Context, attempt int, opts *internalOptions) time.Duration
+}
+
+// AttemptTimeoutError is the cause of the cancellation of an attempt's context
+// when the per-attempt timeout expires, see context.Cause(). It matches
+// context.DeadlineExceeded, see errors.Is().
+type AttemptTimeoutError struct {
+	// Attempt is the zero-based index of the attempt.
+	Attempt int
+	// Timeout is the timeout of the attempt.
+	Timeout time.Duration
+}
+
+func (e *AttemptTimeoutError) Error() string {
+	return fmt.Sprintf("attempt %d timed out after %v", e.Attempt+1, e.Timeout)
+}
+
+// Is returns true if target is context.DeadlineExceeded.
+func (e *AttemptTimeoutError) Is(target error) bool {
+	return target == context.DeadlineExceeded
+}
+
+// Temporary returns true. It implements the Error interface.
+func (e *AttemptTimeoutError) Temporary() bool { return true }
+
+// withAttemptTimeout returns a copy of ctx that is cancelled with an
+// *AttemptTimeoutError when the timeout of attempt expires.
+func withAttemptTimeout(ctx context.Context, attempt int, opts *internalOptions) (context.Context, context.CancelFunc) {
+	var d time.Duration
+	if opts.timeout != nil {
+		d = opts.timeout.timeout(ctx, attempt, opts)
+	}
+	if d <= 0 {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeoutCause(ctx, d, &AttemptTimeoutError{
+		Attempt: attempt,
+		Timeout: d,
+	})
+}
+
+// ExpTimeout sets per-attempt timeouts that grow with each attempt, similar to
+// ExpBackoff: the first attempt times out after Base, and each subsequent
+// timeout is multiplied by Factor until Max is reached. If Max is zero, the
+// timeout is not capped.
+//
+// As with Timeout, the retry logic continues without waiting for the callback
+// to return.
+//
+// Implements the Option interface.
+type ExpTimeout struct {
+	Base   time.Duration
+	Max    time.Duration
+	Factor float64
+}
+
+func (t ExpTimeout) apply(opts *internalOptions) {
+	opts.timeout = t
+}
+
+func (t ExpTimeout) timeout(_ context.Context, attempt int, _ *internalOptions) time.Duration {
+	f := float64(t.Base) * math.Pow(t.Factor, float64(attempt))
+
+	if t.Max != 0 && f > float64(t.Max) {
+		return t.Max
+	}
+	if d := time.Duration(f); d > t.Base {
+		return d
+	}
+	return t.Base
+}
+
+// SplitTimeout divides the time remaining until the context's deadline among
+// the remaining attempts, so that a slow attempt cannot use up the time of all
+// retries. Time for the backoff pauses between the remaining attempts is
+// reserved, using the delays before jitter is applied.
+//
+// By default, the remaining time is divided evenly. Weights sets the relative
+// share of each attempt: Weights[i] is the weight of the attempt with index i
+// (see Attempt()), and attempts beyond the end of Weights use the last weight.
+// For example, with Attempts(3) and Weights {2, 1}, the first attempt may use
+// half of the time, and the others a quarter each. Weights must be positive.
+//
+// Attempts without a deadline, or with an unlimited number of attempts, have
+// no per-attempt timeout.
+//
+// As with Timeout, the retry logic continues without waiting for the callback
+// to return.
+//
+// Implements the Option interface.
+type SplitTimeout struct {
+	Weights []float64
+}
+
+func (t SplitTimeout) apply(opts *internalOptions) {
+	opts.timeout = t
+}
+
+func (t SplitTimeout) weight(attempt int) float64 {
+	switch {
+	case len(t.Weights) == 0:
+		return 1
+	case attempt < len(t.Weights):
+		return t.Weights[attempt]
+	default:
+		return t.Weights[len(t.Weights)-1]
+	}
+}
+
+func (t SplitTimeout) timeout(ctx context.Context, attempt int, opts *internalOptions) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok || opts.Attempts == 0 {
+		return 0
+	}
+
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return 0
+	}
+
+	available := remaining
+	for i := attempt; Attempts(i+1) < opts.Attempts; i++ {
+		available -= opts.delay(i)
+	}
+	// If the backoff pauses do not fit, MinAttemptTime or the deadline end
+	// the call early. Split the remaining time regardless.
+	if available <= 0 {
+		available = remaining
+	}
+
+	var total float64
+	for i := attempt; Attempts(i) < opts.Attempts; i++ {
+		total += t.weight(i)
+	}
+	if total <= 0 {
+		return 0
+	}
+
+	return time.Duration(float64(available) * t.weight(attempt) / total)
+}
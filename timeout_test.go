@@ -0,0 +1,171 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+func ExampleSplitTimeout() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The first attempt may use half of the ten seconds, the second and
+	// third attempt a quarter each, minus the backoff pauses.
+	err := Do(ctx, func(ctx context.Context) error {
+		// Do something that may be slow.
+		return nil
+	}, Attempts(3), SplitTimeout{Weights: []float64{2, 1}})
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func TestExpTimeout(t *testing.T) {
+	cases := []struct {
+		t    ExpTimeout
+		want []time.Duration
+	}{
+		{
+			t:    ExpTimeout{Base: time.Second, Max: 5 * time.Second, Factor: 2},
+			want: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second},
+		},
+		{
+			t:    ExpTimeout{Base: time.Second, Factor: 3},
+			want: []time.Duration{time.Second, 3 * time.Second, 9 * time.Second, 27 * time.Second},
+		},
+		{
+			t:    ExpTimeout{Base: time.Second},
+			want: []time.Duration{time.Second, time.Second},
+		},
+	}
+
+	for _, tc := range cases {
+		for i, want := range tc.want {
+			if got := tc.t.timeout(context.Background(), i, nil); got != want {
+				t.Errorf("%+v.timeout(%d) = %v, want %v", tc.t, i, got, want)
+			}
+		}
+	}
+}
+
+func TestSplitTimeout(t *testing.T) {
+	noBackoff := ExpBackoff{}
+
+	cases := []struct {
+		name    string
+		t       SplitTimeout
+		opts    []Option
+		attempt int
+		want    time.Duration
+	}{
+		{
+			name: "even",
+			opts: []Option{Attempts(4), noBackoff},
+			want: 25 * time.Second,
+		},
+		{
+			name:    "even, last attempt",
+			opts:    []Option{Attempts(4), noBackoff},
+			attempt: 3,
+			want:    100 * time.Second,
+		},
+		{
+			name: "weighted",
+			t:    SplitTimeout{Weights: []float64{2, 1}},
+			opts: []Option{Attempts(3), noBackoff},
+			want: 50 * time.Second,
+		},
+		{
+			name:    "weighted, second attempt",
+			t:       SplitTimeout{Weights: []float64{2, 1}},
+			opts:    []Option{Attempts(3), noBackoff},
+			attempt: 1,
+			want:    50 * time.Second,
+		},
+		{
+			name: "backoff",
+			opts: []Option{Attempts(3), ExpBackoff{Base: 10 * time.Second, Max: 20 * time.Second, Factor: 2}},
+			// (100s - 10s - 20s) / 3
+			want: 70 * time.Second / 3,
+		},
+		{
+			name: "unlimited attempts",
+			opts: []Option{Attempts(0)},
+			want: 0,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+			defer cancel()
+
+			opts := newOptions(tc.opts)
+			got := tc.t.timeout(ctx, tc.attempt, &opts)
+			if got > tc.want || got < tc.want-time.Second {
+				t.Errorf("timeout() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	opts := newOptions(nil)
+	if got := (SplitTimeout{}).timeout(context.Background(), 0, &opts); got != 0 {
+		t.Errorf("timeout() without deadline = %v, want 0", got)
+	}
+}
+
+func TestAttemptTimeoutCause(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu     sync.Mutex
+		causes []error
+	)
+	err := Do(context.Background(), func(ctx context.Context) error {
+		<-ctx.Done()
+
+		mu.Lock()
+		defer mu.Unlock()
+		causes = append(causes, context.Cause(ctx))
+
+		return ctx.Err()
+	}, Attempts(3), rpcTestBackoff, WithoutJitter, ExpTimeout{Base: 10 * time.Millisecond, Factor: 2})
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Do() = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The callbacks return after the retry loop moved on; wait for the last one.
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if got, want := len(causes), 3; got != want {
+		t.Fatalf("got %d causes, want %d", got, want)
+	}
+	for i, cause := range causes {
+		var te *AttemptTimeoutError
+		if !errors.As(cause, &te) {
+			t.Errorf("causes[%d] = %v, want *AttemptTimeoutError", i, cause)
+			continue
+		}
+		if want := 10 * time.Millisecond << i; te.Attempt != i || te.Timeout != want {
+			t.Errorf("causes[%d] = %+v, want attempt %d and timeout %v", i, te, i, want)
+		}
+	}
+
+	// Timeout reports the cause when the callback does not return in time.
+	err = Do(context.Background(), func(ctx context.Context) error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}, Attempts(1), Timeout(time.Millisecond))
+
+	var te *AttemptTimeoutError
+	if !errors.As(err, &te) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Do() = %v, want *AttemptTimeoutError matching %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,97 @@
+package retry
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBudget implements a token bucket based retry budget, modeled after
+// Finagle's RetryBudget. It is an alternative to Budget that is easier to
+// reason about when traffic is low.
+//
+// Each initial call deposits Ratio tokens into the bucket and each retry
+// withdraws one token. Deposited tokens expire after TTL. In addition to the
+// deposited tokens, MinRetriesPerSecond retries are always permitted. If
+// there are not enough tokens in the bucket, the retry is dropped and Do()
+// returns ErrExhausted.
+//
+// For example, with Ratio 0.2 and MinRetriesPerSecond 10, a client sending
+// 100 calls per second may retry 10 + 20 = 30 calls per second.
+//
+// To add a retry budget for a specific service or backend, declare a
+// TokenBudget variable that is shared by all Do() calls and Transports talking
+// to that backend. TokenBudget and Budget are mutually exclusive; if both are
+// passed to Do(), the last one wins.
+//
+// Implements the Option interface.
+type TokenBudget struct {
+	// TTL is the time after which deposited tokens expire.
+	// Defaults to 10 seconds.
+	TTL time.Duration
+
+	// MinRetriesPerSecond is the rate of retries that is permitted
+	// regardless of the number of initial calls.
+	MinRetriesPerSecond float64
+
+	// Ratio is the number of tokens deposited by each initial call, i.e.
+	// the maximum ratio of retries to initial calls (ignoring
+	// MinRetriesPerSecond). For example, 0.2 means that up to 20% of calls
+	// may be retried.
+	Ratio float64
+
+	once        sync.Once
+	deposits    *movingRate
+	withdrawals *movingRate
+}
+
+func (b *TokenBudget) apply(opts *internalOptions) {
+	opts.budget = b
+}
+
+func (b *TokenBudget) ttl() time.Duration {
+	if b.TTL <= 0 {
+		return 10 * time.Second
+	}
+	return b.TTL
+}
+
+func (b *TokenBudget) init() {
+	b.once.Do(func() {
+		// Finagle uses ten slices per TTL, too.
+		b.deposits = newMovingRate(b.ttl(), b.ttl()/10)
+		b.withdrawals = newMovingRate(b.ttl(), b.ttl()/10)
+	})
+}
+
+// balance returns the number of tokens currently in the bucket.
+func (b *TokenBudget) balance(t time.Time) float64 {
+	reserve := b.MinRetriesPerSecond * b.ttl().Seconds()
+	return reserve + b.Ratio*b.deposits.Count(t) - b.withdrawals.Count(t)
+}
+
+// sendOK deposits a token for initial calls and withdraws a token for
+// retries. The initial call is always permitted.
+func (b *TokenBudget) sendOK(isRetry bool) bool {
+	if b == nil {
+		return true
+	}
+
+	b.init()
+
+	t := time.Now()
+
+	if !isRetry {
+		b.deposits.Add(t, 1)
+		return true
+	}
+
+	// Withdraw the token before checking the balance, so that concurrent
+	// retries cannot overdraw the bucket.
+	b.withdrawals.Add(t, 1)
+	if b.balance(t) < 0.0 {
+		b.withdrawals.Add(t, -1)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,154 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+func ExampleTokenBudget() {
+	ctx := context.Background()
+
+	// fooRetryBudget is a global variable holding the state of foo's retry
+	// budget. Up to 10% of calls plus one call per second may be retried.
+	var fooRetryBudget = TokenBudget{
+		MinRetriesPerSecond: 1.0,
+		Ratio:               0.1,
+	}
+
+	// failingRPC is a fake RPC call simulating a temporary backend failure.
+	failingRPC := func(_ context.Context) error {
+		return errors.New("temporary failure")
+	}
+
+	if err := Do(ctx, failingRPC, &fooRetryBudget); err != nil {
+		log.Println(err)
+	}
+}
+
+func TestTokenBudget(t *testing.T) {
+	cases := []struct {
+		name    string
+		budget  *TokenBudget
+		initial int
+		wantOK  int
+	}{
+		{
+			name:    "ratio",
+			budget:  &TokenBudget{Ratio: 0.2},
+			initial: 100,
+			wantOK:  20,
+		},
+		{
+			name:    "minimum rate",
+			budget:  &TokenBudget{MinRetriesPerSecond: 1.0},
+			initial: 100,
+			wantOK:  10,
+		},
+		{
+			name:    "minimum rate with custom TTL",
+			budget:  &TokenBudget{TTL: time.Minute, MinRetriesPerSecond: 0.5},
+			initial: 0,
+			wantOK:  30,
+		},
+		{
+			name:    "ratio and minimum rate",
+			budget:  &TokenBudget{Ratio: 0.1, MinRetriesPerSecond: 1.0},
+			initial: 100,
+			wantOK:  20,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for i := 0; i < c.initial; i++ {
+				if !c.budget.sendOK(false) {
+					t.Fatalf("sendOK(false) = false, want true")
+				}
+			}
+
+			var got int
+			for c.budget.sendOK(true) {
+				got++
+				if got > 1000 {
+					t.Fatal("retry budget is not exhausted after 1000 retries")
+				}
+			}
+
+			if got != c.wantOK {
+				t.Errorf("got %d permitted retries, want %d", got, c.wantOK)
+			}
+		})
+	}
+}
+
+func TestTokenBudgetDo(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b := &TokenBudget{}
+
+	var calls int
+	cb := func(_ context.Context) error {
+		calls++
+		return errors.New("temporary failure")
+	}
+
+	if err := Do(ctx, cb, Attempts(3), b); !errors.Is(err, ErrExhausted) {
+		t.Errorf("Do() = %v, want %v", err, ErrExhausted)
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+}
+
+func TestTokenBudgetConcurrentRetries(t *testing.T) {
+	for _, concurrent := range []bool{false, true} {
+		b := &TokenBudget{Ratio: 0.1}
+		for i := 0; i < 100; i++ {
+			b.sendOK(false)
+		}
+
+		var (
+			wg     sync.WaitGroup
+			mu     sync.Mutex
+			passed int
+			start  = make(chan struct{})
+		)
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if concurrent {
+					<-start
+				}
+				if b.sendOK(true) {
+					mu.Lock()
+					passed++
+					mu.Unlock()
+				}
+			}()
+			if !concurrent {
+				wg.Wait()
+			}
+		}
+		close(start)
+		wg.Wait()
+
+		// 100 initial calls deposit 10 tokens.
+		if concurrent && passed > 10 {
+			t.Errorf("concurrent: %d retries passed, want at most 10", passed)
+		}
+		if !concurrent && passed != 10 {
+			t.Errorf("sequential: %d retries passed, want 10", passed)
+		}
+
+		// Refused retries are not withdrawn.
+		if got := b.withdrawals.count(); got != float64(passed) {
+			t.Errorf("concurrent = %v: withdrew %g tokens, want %d", concurrent, got, passed)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Tracer creates spans. It is a minimal interface that can be implemented on
+// top of tracing libraries, such as OpenTelemetry, without making this
+// package depend on them. See the "otel" sub-module for an OpenTelemetry
+// implementation.
+type Tracer interface {
+	// Start starts a new span. If ctx holds a span, the new span is its
+	// child. Start returns a context holding the new span.
+	Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, Span)
+}
+
+// Span is a span created by Tracer.
+type Span interface {
+	// SetAttributes adds attributes to the span.
+	SetAttributes(attrs ...slog.Attr)
+	// AddEvent adds an event to the span.
+	AddEvent(name string, attrs ...slog.Attr)
+	// End ends the span. err is the result of the operation, if any.
+	End(err error)
+}
+
+// Tracing traces calls with Tracer. Each call creates a span, with one child
+// span per attempt:
+//
+// • The span of the call is named Name and has the "attempts" attribute.
+// Each backoff pause adds a "backoff" event with "attempt" and "delay"
+// attributes.
+//
+// • The spans of the attempts are named "attempt" and have the "attempt"
+// attribute, starting at 1. The callback is called with a context holding the
+// span of the attempt, so that spans created by the callback become children
+// of the attempt.
+//
+// Transport adds "method" and "host" attributes to the call's span, and the
+// "status" attribute to attempts failing because of the response's status
+// code.
+//
+// Implements the Option interface.
+type Tracing struct {
+	Tracer Tracer
+
+	// Name is the name of the call's span. Defaults to "retry.Do", and to
+	// "retry.Transport" for Transport.
+	Name string
+
+	key *traceSpanKey
+}
+
+func (t Tracing) apply(opts *internalOptions) {
+	if t.Tracer == nil {
+		return
+	}
+
+	t.key = new(traceSpanKey)
+	opts.observers = append(opts.observers, t)
+}
+
+// traceSpanKey is the context key of the call's span. Each Tracing observer
+// uses its own key, so that multiple Tracing options and nested calls do not
+// interfere.
+type traceSpanKey struct {
+	_ byte // ensures that keys have distinct addresses
+}
+
+type traceNameKey struct{}
+
+// withTraceName returns a context specifying the default name of spans
+// created by Tracing.
+func withTraceName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, traceNameKey{}, name)
+}
+
+func (t Tracing) name(ctx context.Context) string {
+	if t.Name != "" {
+		return t.Name
+	}
+	if name, ok := ctx.Value(traceNameKey{}).(string); ok {
+		return name
+	}
+	return "retry.Do"
+}
+
+func (t Tracing) start(ctx context.Context) context.Context {
+	ctx, span := t.Tracer.Start(ctx, t.name(ctx), logAttrs(ctx, nil)...)
+	return context.WithValue(ctx, t.key, span)
+}
+
+func (t Tracing) span(ctx context.Context) Span {
+	span, _ := ctx.Value(t.key).(Span)
+	return span
+}
+
+func (t Tracing) attempt(ctx context.Context, attempt int) (context.Context, func(error)) {
+	ctx, span := t.Tracer.Start(ctx, "attempt", slog.Int("attempt", attempt+1))
+
+	return ctx, func(err error) {
+		var se statusError
+		if errors.As(err, &se) {
+			span.SetAttributes(slog.Int("status", se.code))
+		}
+		span.End(err)
+	}
+}
+
+func (t Tracing) backoff(ctx context.Context, attempt int, _ error, delay time.Duration) {
+	if span := t.span(ctx); span != nil {
+		span.AddEvent("backoff", slog.Int("attempt", attempt+1), slog.Duration("delay", delay))
+	}
+}
+
+func (t Tracing) done(ctx context.Context, attempts int, err error) {
+	if span := t.span(ctx); span != nil {
+		span.SetAttributes(slog.Int("attempts", attempts))
+		span.End(err)
+	}
+}
+
+// TraceRecorder is an in-memory Tracer, intended for tests.
+type TraceRecorder struct {
+	mu    sync.Mutex
+	spans []*RecordedSpan
+}
+
+// RecordedSpan is a span recorded by TraceRecorder.
+type RecordedSpan struct {
+	Name string
+	// Parent is the parent span, or nil.
+	Parent *RecordedSpan
+	Attrs  []slog.Attr
+	Events []RecordedEvent
+	Err    error
+	Ended  bool
+
+	rec *TraceRecorder
+}
+
+// RecordedEvent is a span event recorded by TraceRecorder.
+type RecordedEvent struct {
+	Name  string
+	Attrs []slog.Attr
+}
+
+type recorderSpanKey struct{}
+
+// Start implements the Tracer interface.
+func (r *TraceRecorder) Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	parent, _ := ctx.Value(recorderSpanKey{}).(*RecordedSpan)
+	if parent != nil && parent.rec != r {
+		parent = nil
+	}
+
+	s := &RecordedSpan{
+		Name:   name,
+		Parent: parent,
+		Attrs:  append([]slog.Attr(nil), attrs...),
+		rec:    r,
+	}
+	r.spans = append(r.spans, s)
+
+	return context.WithValue(ctx, recorderSpanKey{}, s), s
+}
+
+// Spans returns the recorded spans in the order they were started. The spans
+// must not be modified while they are in use.
+func (r *TraceRecorder) Spans() []*RecordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]*RecordedSpan(nil), r.spans...)
+}
+
+// Attr returns the value of the attribute with key, if any.
+func (s *RecordedSpan) Attr(key string) (slog.Value, bool) {
+	s.rec.mu.Lock()
+	defer s.rec.mu.Unlock()
+
+	for i := len(s.Attrs) - 1; i >= 0; i-- {
+		if s.Attrs[i].Key == key {
+			return s.Attrs[i].Value, true
+		}
+	}
+	return slog.Value{}, false
+}
+
+// SetAttributes implements the Span interface.
+func (s *RecordedSpan) SetAttributes(attrs ...slog.Attr) {
+	s.rec.mu.Lock()
+	defer s.rec.mu.Unlock()
+
+	s.Attrs = append(s.Attrs, attrs...)
+}
+
+// AddEvent implements the Span interface.
+func (s *RecordedSpan) AddEvent(name string, attrs ...slog.Attr) {
+	s.rec.mu.Lock()
+	defer s.rec.mu.Unlock()
+
+	s.Events = append(s.Events, RecordedEvent{
+		Name:  name,
+		Attrs: append([]slog.Attr(nil), attrs...),
+	})
+}
+
+// End implements the Span interface.
+func (s *RecordedSpan) End(err error) {
+	s.rec.mu.Lock()
+	defer s.rec.mu.Unlock()
+
+	s.Err = err
+	s.Ended = true
+}
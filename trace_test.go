@@ -0,0 +1,116 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func ExampleTracing() {
+	// In tests, TraceRecorder records spans in memory. In production, use
+	// a Tracer backed by a tracing library, e.g. the "otel" sub-module.
+	rec := &TraceRecorder{}
+
+	_ = Do(context.Background(), func(ctx context.Context) error {
+		return nil
+	}, Tracing{Tracer: rec})
+}
+
+func TestTracing(t *testing.T) {
+	rec := &TraceRecorder{}
+	errFailed := errors.New("temporary failure")
+
+	var calls int
+	err := Do(context.Background(), func(ctx context.Context) error {
+		calls++
+		_, span := rec.Start(ctx, "callback")
+		span.End(nil)
+
+		if calls < 3 {
+			return errFailed
+		}
+		return nil
+	}, rpcTestBackoff, Tracing{Tracer: rec})
+	if err != nil {
+		t.Fatalf("Do() = %v", err)
+	}
+
+	spans := rec.Spans()
+	if got, want := len(spans), 7; got != want {
+		t.Fatalf("got %d spans, want %d", got, want)
+	}
+
+	root := spans[0]
+	if root.Name != "retry.Do" || root.Parent != nil || !root.Ended || root.Err != nil {
+		t.Errorf("root span = %+v, want ended \"retry.Do\" span without parent and error", root)
+	}
+	if v, _ := root.Attr("attempts"); v.Int64() != 3 {
+		t.Errorf("attempts = %v, want 3", v)
+	}
+	if got, want := len(root.Events), 2; got != want {
+		t.Errorf("got %d events, want %d", got, want)
+	}
+	for _, ev := range root.Events {
+		if ev.Name != "backoff" {
+			t.Errorf("event name = %q, want %q", ev.Name, "backoff")
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		attempt, callback := spans[1+2*i], spans[2+2*i]
+
+		if attempt.Name != "attempt" || attempt.Parent != root || !attempt.Ended {
+			t.Errorf("spans[%d] = %+v, want ended \"attempt\" span, child of the root span", 1+2*i, attempt)
+		}
+		if v, _ := attempt.Attr("attempt"); v.Int64() != int64(i+1) {
+			t.Errorf("spans[%d]: attempt = %v, want %d", 1+2*i, v, i+1)
+		}
+		if wantErr := i < 2; (attempt.Err != nil) != wantErr {
+			t.Errorf("spans[%d]: Err = %v, want error: %v", 1+2*i, attempt.Err, wantErr)
+		}
+
+		if callback.Parent != attempt {
+			t.Errorf("spans[%d]: parent = %v, want the attempt's span", 2+2*i, callback.Parent)
+		}
+	}
+}
+
+func TestTracingTransport(t *testing.T) {
+	rec := &TraceRecorder{}
+
+	c := &http.Client{
+		Transport: NewTransport(&testTransport{status: []int{503, 200}},
+			rpcTestBackoff, Tracing{Tracer: rec}),
+	}
+
+	res, err := c.Post("http://example.com/", "text/plain", strings.NewReader("request payload"))
+	if err != nil {
+		t.Fatalf("Post() = %v", err)
+	}
+	res.Body.Close()
+
+	spans := rec.Spans()
+	if got, want := len(spans), 3; got != want {
+		t.Fatalf("got %d spans, want %d", got, want)
+	}
+
+	root := spans[0]
+	if got, want := root.Name, "retry.Transport"; got != want {
+		t.Errorf("root span name = %q, want %q", got, want)
+	}
+	if v, _ := root.Attr("method"); v.String() != "POST" {
+		t.Errorf("method = %v, want POST", v)
+	}
+	if v, _ := root.Attr("host"); v.String() != "example.com" {
+		t.Errorf("host = %v, want example.com", v)
+	}
+
+	if v, ok := spans[1].Attr("status"); !ok || v.Int64() != 503 {
+		t.Errorf("first attempt: status = %v, want 503", v)
+	}
+	if _, ok := spans[2].Attr("status"); ok {
+		t.Error("second attempt has a status attribute, want none")
+	}
+}